@@ -0,0 +1,72 @@
+package failover
+
+import "time"
+
+// checkAllDown tracks how long every one of m's links has been failing its
+// checks, after they've all been checked. Once it's been
+// cfg.BothDownTimeout, it runs the OnBothDown hook, and sends an "all_down"
+// webhook, as a dead man's switch for unattended sites, e.g. to reboot a
+// modem or raise an alert. That's only done once per outage, until a link
+// passes a check again. Since the outage is timed from the first check at the
+// earliest, interfaces that are still coming up at startup get the whole
+// timeout to do so.
+func (m *monitor) checkAllDown() {
+	if m.cfg.BothDownTimeout <= 0 {
+		return
+	}
+	for _, l := range m.links {
+		if l.lastCheckErr != nil {
+			continue
+		}
+		if m.allDownFired {
+			m.log.Info("interface up again after every interface was down", "event", "all_down", "interface", l.iface.Name, "down_for", time.Since(m.allDownSince).Round(time.Second))
+		}
+		m.allDownSince = time.Time{}
+		m.allDownFired = false
+		return
+	}
+
+	if m.allDownSince.IsZero() {
+		m.allDownSince = time.Now()
+		return
+	}
+	down := time.Since(m.allDownSince)
+	if m.allDownFired || down < m.cfg.BothDownTimeout {
+		return
+	}
+	m.allDownFired = true
+
+	m.log.Error("EVERY INTERFACE HAS BEEN DOWN TOO LONG; running recovery action", "event", "all_down", "down_for", down.Round(time.Second), "timeout", m.cfg.BothDownTimeout, "hook", m.cfg.OnBothDown)
+	if m.cfg.DryRun {
+		m.log.Info("dry run; not running recovery action", "event", "dry_run", "hook", m.cfg.OnBothDown)
+		return
+	}
+
+	l := m.links[0]
+	if i := m.linkIndex(m.active); i >= 0 {
+		l = m.links[i]
+	}
+	reason := "every interface has been down for " + down.Round(time.Second).String()
+	m.hooks.Add(1)
+	go func() {
+		defer m.hooks.Done()
+		runHook(m.log, m.cfg.OnBothDown, m.cfg.HookTimeout, m.group, m.cfg.Family, "all_down", l.iface, l.gw, l.iface, l.gw, reason)
+	}()
+	ev := webhookEvent{
+		Event:     "all_down",
+		Group:     m.group,
+		Family:    m.cfg.Family,
+		Timestamp: time.Now(),
+		From:      l.iface.Name,
+		To:        l.iface.Name,
+		Reason:    reason,
+	}
+	m.mqtt.event(ev)
+	if m.cfg.WebhookURL != "" {
+		m.hooks.Add(1)
+		go func() {
+			defer m.hooks.Done()
+			sendWebhook(m.log, m.cfg.WebhookURL, m.cfg.WebhookHeaders, ev)
+		}()
+	}
+}
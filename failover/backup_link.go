@@ -0,0 +1,167 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// errStandby is the check error for a link whose interface has been set down
+// by --manage-backup-link because it isn't needed.
+var errStandby = errors.New("interface set down while it isn't needed")
+
+// raiseBackups brings up any of m's backup interfaces that are down and
+// whose gateways are autodetected, with --manage-backup-link, so that they
+// can be detected at startup. They're set down again by standbyBackups once
+// the active interface passes a check.
+func (m *monitor) raiseBackups() {
+	for _, b := range m.cfg.Backups {
+		if b.Gateway != "" {
+			continue
+		}
+		iface, err := lookupInterface(b.Name)
+		if err != nil || iface.Flags&net.FlagUp != 0 {
+			// A missing interface is reported when setting up
+			// the links.
+			continue
+		}
+		if err := setInterfaceUp(m.cfg, iface, true, "bringing up backup interface to detect its gateway"); err != nil {
+			m.log.Warn("error bringing up backup interface", "event", "error", "interface", b.Name, "error", err)
+		}
+	}
+}
+
+// standbyBackups sets down each backup interface that isn't needed while the
+// link at index active is healthy: all of them, other than active's own and
+// the primary's, and any they're stacked on, any that policy routing rules
+// send traffic via, and any brought up less than cfg.BackupLinkTimeout ago.
+// They're checked again once they're brought back up by wakeBackup.
+func (m *monitor) standbyBackups(active int) {
+	needed := []*net.Interface{m.links[active].iface, m.links[0].iface}
+	for _, l := range m.links[1:] {
+		if l.standby || m.waking(l) || m.hasRulesVia(l.name) {
+			continue
+		}
+		if slices.ContainsFunc(needed, func(iface *net.Interface) bool {
+			return iface.Index == l.iface.Index || stackedOn(iface, l.iface.Index)
+		}) {
+			continue
+		}
+		if err := m.setLinkUp(l.iface, false, "setting backup interface down while it isn't needed"); err != nil {
+			m.log.Warn("error setting backup interface down", "event", "error", "interface", l.iface.Name, "error", err)
+		}
+	}
+}
+
+// wakeBackup brings up the first backup interface after the link at index
+// active that's on standby, to fail over to once it passes checks. If one was
+// brought up less than cfg.BackupLinkTimeout ago, it's waited for instead. It
+// reports whether there's a backup being brought up.
+func (m *monitor) wakeBackup(active int) bool {
+	for _, l := range m.links[active+1:] {
+		if m.waking(l) {
+			m.log.Debug("waiting for backup interface to come up", "event", "backup_link", "interface", l.iface.Name, "since", l.wokenAt)
+			return true
+		}
+	}
+	for _, l := range m.links[active+1:] {
+		if !l.standby {
+			continue
+		}
+		if err := m.setLinkUp(l.iface, true, "bringing up backup interface to fail over to"); err != nil {
+			m.log.Error("error bringing up backup interface", "event", "error", "interface", l.iface.Name, "error", err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// waking reports whether l's interface was brought up from standby less than
+// cfg.BackupLinkTimeout ago.
+func (m *monitor) waking(l *link) bool {
+	return !l.wokenAt.IsZero() && time.Since(l.wokenAt) < m.cfg.BackupLinkTimeout
+}
+
+// wakeLink brings up l's interface if it's on standby, e.g. to pin the
+// default route to it, and reports whether it was.
+func (m *monitor) wakeLink(l *link) (bool, error) {
+	if !l.standby {
+		return false, nil
+	}
+	return true, m.setLinkUp(l.iface, true, "bringing up backup interface")
+}
+
+// setLinkUp sets iface administratively up or down, logging msg, and records
+// whether each of m's links via it is on standby, and if it was brought up,
+// when.
+func (m *monitor) setLinkUp(iface *net.Interface, up bool, msg string) error {
+	// Set the links' state first, so that the netlink update for the
+	// change isn't reported as losing carrier.
+	m.mu.Lock()
+	for _, l := range m.links {
+		if l.iface.Index == iface.Index {
+			l.standby = !up
+		}
+	}
+	m.mu.Unlock()
+	err := setInterfaceUp(m.cfg, iface, up, msg)
+	m.mu.Lock()
+	for _, l := range m.links {
+		if l.iface.Index != iface.Index {
+			continue
+		}
+		if err != nil {
+			l.standby = up
+		} else if up {
+			l.wokenAt = time.Now()
+		}
+	}
+	m.mu.Unlock()
+	return err
+}
+
+// setInterfaceUp sets iface administratively up or down, unless cfg.DryRun is
+// set, logging msg.
+func setInterfaceUp(cfg *Config, iface *net.Interface, up bool, msg string) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+	log := monitorLogger(cfg)
+	log.Info(msg, "event", "backup_link", "interface", iface.Name, "state", state)
+	if cfg.DryRun {
+		log.Info("dry run; not changing interface", "event", "dry_run", "command", fmt.Sprintf("ip link set %s %s", iface.Name, state))
+		return nil
+	}
+
+	link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: iface.Index, Name: iface.Name}}
+	var err error
+	if up {
+		err = nl.LinkSetUp(link)
+	} else {
+		err = nl.LinkSetDown(link)
+	}
+	if err != nil {
+		return fmt.Errorf("setting %s %s: %w", iface.Name, state, err)
+	}
+	return nil
+}
+
+// stackedOn reports whether iface is stacked on the interface at index, e.g.
+// as a VLAN on its parent, so that setting that interface down would take
+// iface down with it.
+func stackedOn(iface *net.Interface, index int) bool {
+	link, err := nl.LinkByIndex(iface.Index)
+	return err == nil && link.Attrs().ParentIndex == index
+}
+
+// hasRulesVia reports whether any of m's policy routing rules send traffic
+// via the interface with the given configured name.
+func (m *monitor) hasRulesVia(name string) bool {
+	return slices.ContainsFunc(m.cfg.Rules, func(r RuleConfig) bool { return r.Interface == name })
+}
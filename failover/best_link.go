@@ -0,0 +1,121 @@
+package failover
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// scoreSamples is how many of a link's most recent checks its
+	// --best-link score is computed over.
+	scoreSamples = 20
+	// scoreRTTPerPoint is how much mean round-trip time costs a link one
+	// point of its --best-link score, so that 10ms of latency weighs the
+	// same as 1% packet loss.
+	scoreRTTPerPoint = 10 * time.Millisecond
+)
+
+// recordScore records the result of a check via l, which took rtt if the
+// check method measures it, for its --best-link score.
+func (m *monitor) recordScore(l *link, rtt time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l.results = append(l.results, err == nil)
+	if len(l.results) > scoreSamples {
+		l.results = l.results[len(l.results)-scoreSamples:]
+	}
+	if err == nil && rtt > 0 {
+		l.scoreRTTs = append(l.scoreRTTs, rtt)
+		if len(l.scoreRTTs) > scoreSamples {
+			l.scoreRTTs = l.scoreRTTs[len(l.scoreRTTs)-scoreSamples:]
+		}
+	}
+}
+
+// score returns l's --best-link score, from 0 to 100: the percentage of its
+// last scoreSamples checks that passed, which is 100 less the loss, less a
+// point for each scoreRTTPerPoint of the mean round-trip time of the
+// successful ones, if the check method measures it, rounded to one decimal
+// place. A single failed check doesn't take the link out of the running; it's
+// switched away from once FailThreshold of them in a row do, as usual.
+func (l *link) score() float64 {
+	if len(l.results) == 0 {
+		return 0
+	}
+	passed := 0
+	for _, ok := range l.results {
+		if ok {
+			passed++
+		}
+	}
+	score := 100 * float64(passed) / float64(len(l.results))
+	if len(l.scoreRTTs) > 0 {
+		var total time.Duration
+		for _, d := range l.scoreRTTs {
+			total += d
+		}
+		mean := total / time.Duration(len(l.scoreRTTs))
+		score -= float64(mean) / float64(scoreRTTPerPoint)
+	}
+	return max(math.Round(score*10)/10, 0)
+}
+
+// checkBest switches the default route, with --best-link, from the link at
+// index active to whichever scores highest among the others that have passed
+// cfg.RecoverThreshold checks in a row, if it scores at least
+// cfg.BestLinkHysteresis more, so that small differences between links don't
+// make it flap between them. If the active link fails cfg.FailThreshold
+// checks in a row, it's switched from to the highest-scoring of them,
+// however it scores. Ties go to the link that comes first in priority order.
+// The links must have just been checked.
+func (m *monitor) checkBest(active int) error {
+	m.mu.Lock()
+	scores := make([]float64, len(m.links))
+	for i, l := range m.links {
+		scores[i] = l.score()
+	}
+	m.mu.Unlock()
+
+	best := -1
+	for i, l := range m.links {
+		if i == active || l.lastCheckErr != nil || l.successes < m.cfg.RecoverThreshold {
+			continue
+		}
+		if best < 0 || scores[i] > scores[best] {
+			best = i
+		}
+	}
+
+	m.interval = m.cfg.Check.Interval
+	cur := m.links[active]
+	if cur.lastCheckErr != nil && cur.failures >= m.cfg.FailThreshold {
+		if best < 0 {
+			m.log.Warn("all interfaces down; staying on current one", "event", "all_down", "interface", cur.iface.Name)
+			return nil
+		}
+		to := m.links[best]
+		m.log.Info("best link chosen", "event", "best_link", "interface", to.iface.Name, "gateway", to.gw, "score", scores[best], "from", cur.iface.Name, "from_score", scores[active])
+		return m.switchTo(active, best, fmt.Sprintf("%d consecutive failed checks via %s: %v; %s scores %.1f", cur.failures, cur.iface.Name, cur.lastCheckErr, to.iface.Name, scores[best]))
+	}
+
+	if best < 0 || scores[best] < scores[active]+m.cfg.BestLinkHysteresis {
+		m.log.Debug("current interface scores best; doing nothing", "event", "check_state", "interface", cur.iface.Name, "score", scores[active], "scores", m.scoreList(scores))
+		return nil
+	}
+	to := m.links[best]
+	m.log.Info("best link chosen", "event", "best_link", "interface", to.iface.Name, "gateway", to.gw, "score", scores[best], "from", cur.iface.Name, "from_score", scores[active])
+	return m.switchTo(active, best, fmt.Sprintf("%s scores %.1f, over %.1f for %s", to.iface.Name, scores[best], scores[active], cur.iface.Name))
+}
+
+// scoreList formats the scores of m's links, by index, for logging.
+func (m *monitor) scoreList(scores []float64) string {
+	var s string
+	for i, l := range m.links {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%s=%.1f", l.iface.Name, scores[i])
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// errNoCarrier is the check error for a link whose interface has lost carrier,
+// been set down, or been removed. It's definitive, so the link is considered
+// down right away rather than after the fail threshold.
+var errNoCarrier = errors.New("interface has no carrier")
+
+// subscribeLinks subscribes to netlink updates about network interfaces,
+// starting with their current state, until ctx is done. If the subscription
+// fails, it returns nil, and interfaces going down are only noticed by the
+// periodic checks.
+func (m *monitor) subscribeLinks(ctx context.Context) <-chan netlink.LinkUpdate {
+	// Buffer a few updates, so that the kernel doesn't drop them while
+	// we're busy checking.
+	ch := make(chan netlink.LinkUpdate, 16)
+	err := linkSubscribe(ch, ctx.Done(), netlink.LinkSubscribeOptions{
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			switch {
+			case ctx.Err() != nil:
+			case strings.HasPrefix(err.Error(), "Wrong sender portid"):
+				// Messages from other netlink sockets, such as
+				// another failover group's subscription, are
+				// skipped without ending the subscription.
+				m.log.Debug("ignored link update", "event", "carrier", "error", err)
+			default:
+				m.log.Warn("error receiving link updates", "event", "error", "error", err)
+			}
+		},
+	})
+	if err != nil {
+		m.log.Warn("error subscribing to link updates; relying on periodic checks", "event", "error", "error", err)
+		return nil
+	}
+	return ch
+}
+
+// handleLinkUpdate records whether the interface in u has carrier, if it's
+// one of m's, and reports whether that's changed for any of m's links.
+func (m *monitor) handleLinkUpdate(u netlink.LinkUpdate) bool {
+	if u.Header.Type == unix.RTM_NEWLINK {
+		m.reresolveLinks(u)
+	}
+	return m.setCarrier(int(u.Index), u.Header.Type != unix.RTM_DELLINK && hasCarrier(u.Flags))
+}
+
+// refreshCarrier looks up whether each of m's interfaces has carrier, as
+// netlink updates would report, since there are none before the run loop
+// subscribes to them, as in the first check or with --oneshot, or if the
+// subscription fails.
+func (m *monitor) refreshCarrier() {
+	seen := make(map[int]bool)
+	for _, l := range m.links {
+		if seen[l.iface.Index] {
+			continue
+		}
+		seen[l.iface.Index] = true
+
+		link, err := nl.LinkByIndex(l.iface.Index)
+		var notFound netlink.LinkNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			m.setCarrier(l.iface.Index, false)
+		case err != nil:
+			m.log.Warn("error getting interface state", "event", "error", "interface", l.iface.Name, "error", err)
+		default:
+			m.setCarrier(l.iface.Index, hasCarrier(link.Attrs().RawFlags))
+		}
+	}
+}
+
+// hasCarrier reports whether an interface with the given flags is up and has
+// carrier.
+func hasCarrier(flags uint32) bool {
+	return flags&unix.IFF_UP != 0 && flags&unix.IFF_LOWER_UP != 0
+}
+
+// setCarrier records whether the interface with the given index has carrier,
+// for each of m's links via it, and reports whether that's changed for any
+// of them.
+func (m *monitor) setCarrier(index int, up bool) bool {
+	changed := false
+	for _, l := range m.links {
+		if l.iface.Index != index || l.noCarrier == !up {
+			continue
+		}
+		if !changed && !l.standby {
+			if up {
+				m.log.Info("interface has carrier", "event", "carrier", "interface", l.iface.Name)
+			} else {
+				m.log.Warn("interface lost carrier", "event", "carrier", "interface", l.iface.Name)
+			}
+		}
+		l.noCarrier = !up
+		changed = true
+	}
+	return changed
+}
+
+// reresolveLinks updates m's links for the interface in u if it's been
+// recreated with a new index, e.g. by plugging a USB modem back in, so that
+// routes via it use the new index, or for links configured by MAC address,
+// if it's been renamed, or recreated with a new name.
+func (m *monitor) reresolveLinks(u netlink.LinkUpdate) {
+	attrs := u.Attrs()
+	var iface *net.Interface
+	for _, l := range m.links {
+		if l.iface.Index == attrs.Index && l.iface.Name == attrs.Name {
+			continue
+		}
+		if mac, err := net.ParseMAC(l.name); err == nil {
+			if !bytes.Equal(attrs.HardwareAddr, mac) {
+				continue
+			}
+		} else if l.iface.Name != attrs.Name {
+			continue
+		}
+		if iface == nil {
+			var err error
+			if iface, err = lookupInterface(l.name); err != nil {
+				m.log.Warn("error looking up recreated interface", "event", "error", "interface", l.iface.Name, "error", err)
+				return
+			} else if iface.Index == l.iface.Index && iface.Name == l.iface.Name {
+				// Another interface sharing its MAC address.
+				return
+			}
+			if iface.Index == l.iface.Index {
+				m.log.Info("interface renamed", "event", "carrier", "interface", iface.Name, "old_name", l.iface.Name)
+			} else {
+				m.log.Info("interface recreated", "event", "carrier", "interface", iface.Name, "index", iface.Index, "old_name", l.iface.Name, "old_index", l.iface.Index)
+			}
+		}
+		// The links for an interface's gateways share its
+		// net.Interface.
+		m.mu.Lock()
+		l.iface = iface
+		m.mu.Unlock()
+		m.routesStale = true
+	}
+}
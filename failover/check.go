@@ -0,0 +1,544 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// A Checker checks whether the upstream is reachable via a given interface.
+type Checker interface {
+	// Check returns nil if the upstream is reachable via iface, or an
+	// error describing why it isn't.
+	Check(ctx context.Context, iface *net.Interface) error
+}
+
+// An rttChecker is a Checker that also measures the round-trip time to the
+// upstream.
+type rttChecker interface {
+	Checker
+
+	// CheckRTT is like Check, but also returns the round-trip time of a
+	// successful check, or zero if it's unknown.
+	CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error)
+}
+
+// checkRTT runs c against iface, and returns the round-trip time if c
+// measures it.
+func checkRTT(ctx context.Context, c Checker, iface *net.Interface) (time.Duration, error) {
+	if rc, ok := c.(rttChecker); ok {
+		return rc.CheckRTT(ctx, iface)
+	}
+	return 0, c.Check(ctx, iface)
+}
+
+// newChecker returns the Checker for the methods in cfg.Method, checking
+// upstreams in the given netlink address family. With multiple methods,
+// either all or any of them must pass, according to cfg.Combine. If
+// cfg.CaptivePortalURL is set, it must also pass a captive portal check.
+func newChecker(cfg *CheckConfig, family int) (Checker, error) {
+	methods := cfg.methods()
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no check method given")
+	}
+	checkers := make([]Checker, 0, len(methods))
+	for _, method := range methods {
+		c, err := newMethodChecker(cfg, method, family)
+		if err != nil {
+			return nil, err
+		}
+		checkers = append(checkers, &timeoutChecker{c, method, cfg.methodTimeout(method)})
+	}
+
+	var checker Checker
+	switch {
+	case len(checkers) == 1:
+		checker = checkers[0]
+	case cfg.Combine == "any":
+		checker = &anyChecker{checkers: checkers}
+	default:
+		checker = &allChecker{checkers: checkers}
+	}
+	// Checking the gateway first is quick, and gives a more specific error
+	// if that's the problem.
+	var local []Checker
+	if cfg.Neighbor {
+		local = append(local, &timeoutChecker{&neighborChecker{timeout: cfg.Timeout}, "neighbor", cfg.methodTimeout("neighbor")})
+	}
+	if cfg.Gateway {
+		local = append(local, &timeoutChecker{
+			&gatewayChecker{timeout: cfg.Timeout, count: cfg.Count, maxLoss: cfg.MaxLoss},
+			"gateway",
+			cfg.methodTimeout("gateway"),
+		})
+	}
+	if len(local) > 0 {
+		checker = &allChecker{checkers: append(local, checker)}
+	}
+	if cfg.CaptivePortalURL == "" {
+		return checker, nil
+	}
+
+	if err := validateHTTPURL(cfg.CaptivePortalURL); err != nil {
+		return nil, fmt.Errorf("invalid captive portal URL: %w", err)
+	}
+	proxy, err := parseProxyURL(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check proxy: %w", err)
+	}
+	return &allChecker{checkers: []Checker{
+		checker,
+		&timeoutChecker{&captivePortalChecker{&httpChecker{
+			url:          cfg.CaptivePortalURL,
+			expectStatus: http.StatusNoContent,
+			expectEmpty:  true,
+			proxy:        proxy,
+			family:       family,
+			timeout:      cfg.Timeout,
+		}}, "", cfg.Timeout},
+	}}, nil
+}
+
+// methodTimeout returns how long a check with the given method may take: the
+// check timeout, or for the methods that send Count echo requests, the ping
+// deadline, if set, or otherwise the check timeout for each of them.
+func (c *CheckConfig) methodTimeout(method string) time.Duration {
+	switch method {
+	case "ping", "icmp-native", "gateway":
+		if c.PingDeadline > 0 {
+			return c.PingDeadline
+		}
+		return c.Timeout * time.Duration(c.Count)
+	}
+	return c.Timeout
+}
+
+// timeoutChecker fails a check by its Checker that takes longer than its
+// timeout. The Checker should give up once its context is done; ping is
+// killed. Errors are prefixed with the check method, if set, so that the
+// reason for a failover says which check failed.
+type timeoutChecker struct {
+	Checker
+	method  string
+	timeout time.Duration
+}
+
+func (c *timeoutChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+func (c *timeoutChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	rtt, err := checkRTT(ctx, c.Checker, iface)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("check timed out after %v: %w", c.timeout, err)
+	}
+	if err != nil && c.method != "" {
+		return 0, fmt.Errorf("%s check: %w", c.method, err)
+	}
+	return rtt, err
+}
+
+// newMethodChecker returns the Checker for a single check method.
+func newMethodChecker(cfg *CheckConfig, method string, family int) (Checker, error) {
+	ports, err := parsePortRange(cfg.SourcePort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check source port: %w", err)
+	}
+
+	switch method {
+	case "ping", "icmp-native":
+		return newTargetChecker(cfg, method, family)
+	case "gateway":
+		return &gatewayChecker{timeout: cfg.Timeout, count: cfg.Count, maxLoss: cfg.MaxLoss}, nil
+	case "neighbor":
+		return &neighborChecker{timeout: cfg.Timeout}, nil
+	case "tcp":
+		if cfg.TCPAddr == "" {
+			return nil, fmt.Errorf("--check-tcp-addr is required for the tcp check method")
+		}
+		if _, _, err := net.SplitHostPort(cfg.TCPAddr); err != nil {
+			return nil, fmt.Errorf("invalid TCP check address %q: %w", cfg.TCPAddr, err)
+		}
+		return &tcpChecker{addr: cfg.TCPAddr, family: family, ports: ports, timeout: cfg.Timeout}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("--check-url is required for the http check method")
+		}
+		if err := validateHTTPURL(cfg.URL); err != nil {
+			return nil, fmt.Errorf("invalid check URL: %w", err)
+		}
+		proxy, err := parseProxyURL(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid check proxy: %w", err)
+		}
+		return &httpChecker{
+			url:          cfg.URL,
+			expectStatus: cfg.ExpectStatus,
+			expectBody:   cfg.ExpectBody,
+			maxRedirects: cfg.MaxRedirects,
+			proxy:        proxy,
+			family:       family,
+			ports:        ports,
+			timeout:      cfg.Timeout,
+		}, nil
+	case "dns":
+		if cfg.DNSName == "" {
+			return nil, fmt.Errorf("--check-dns-name is required for the dns check method")
+		}
+		server := cfg.DNSServer
+		if server == "" {
+			server = net.JoinHostPort(defaultCheckIP(family).String(), "53")
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS check server %q: %w", server, err)
+		}
+		name := cfg.DNSName
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		return &dnsChecker{name: name, server: server, family: family, ports: ports, timeout: cfg.Timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown check method %q", method)
+	}
+}
+
+// newTargetChecker returns a Checker for the cfg.IPs targets, using the given
+// method, ping or icmp-native. If there are multiple targets, they're checked
+// concurrently and must satisfy cfg.Quorum, or with cfg.TargetSelection, one
+// of them is checked each time; see selectingChecker.
+func newTargetChecker(cfg *CheckConfig, method string, family int) (Checker, error) {
+	var targets []string
+	var weights []int
+	for _, s := range cfg.IPs {
+		target, weight, err := splitTargetWeight(s)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+		weights = append(weights, weight)
+	}
+	if len(targets) == 0 {
+		targets = []string{defaultCheckIP(family).String()}
+		weights = []int{1}
+	}
+	if cfg.Quorum < 1 || cfg.Quorum > len(targets) {
+		return nil, fmt.Errorf("check quorum must be between 1 and the number of check IPs (%d), got %d", len(targets), cfg.Quorum)
+	}
+
+	var args []string
+	if method == "ping" {
+		args = strings.Fields(cfg.PingArgs)
+		if !hasTargetArg(args) {
+			return nil, fmt.Errorf("ping arguments %q must include {target}", cfg.PingArgs)
+		}
+		if cfg.PingTOS != 0 {
+			args = append([]string{"-Q", strconv.Itoa(cfg.PingTOS)}, args...)
+		}
+		if cfg.PingSize != 0 {
+			args = append([]string{"-s", strconv.Itoa(cfg.PingSize)}, args...)
+		}
+		if cfg.PingDeadline > 0 {
+			secs := int(math.Ceil(cfg.PingDeadline.Seconds()))
+			args = append([]string{"-w", strconv.Itoa(secs)}, args...)
+		}
+		if err := probePing(cfg.PingPath, args, family); err != nil {
+			// Keep going, in case it was something transient; every
+			// check will fail with the same error otherwise.
+			slog.Error("ping doesn't work; set --ping-path and --ping-args to match the installed ping, or use --check-method=icmp-native", "event", "error", "path", cfg.PingPath, "args", cfg.PingArgs, "error", err)
+		}
+	}
+
+	checkers := make([]Checker, 0, len(targets))
+	for _, target := range targets {
+		addr, err := netip.ParseAddr(target)
+		if err == nil && !familyMatches(addr, family) {
+			return nil, fmt.Errorf("check IP %v is not an IPv%d address", addr, ipVersion(family))
+		}
+
+		if method == "ping" {
+			checkers = append(checkers, &pingChecker{
+				path:    cfg.PingPath,
+				args:    args,
+				target:  target,
+				family:  family,
+				count:   cfg.Count,
+				maxLoss: cfg.MaxLoss,
+			})
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid check IP %q: %w", target, err)
+		}
+		checkers = append(checkers, &icmpChecker{
+			target:  addr.Unmap(),
+			timeout: cfg.Timeout,
+			count:   cfg.Count,
+			maxLoss: cfg.MaxLoss,
+			size:    cfg.PingSize,
+			tos:     cfg.PingTOS,
+		})
+	}
+
+	if len(checkers) == 1 {
+		return checkers[0], nil
+	}
+	if cfg.TargetSelection == "random" || cfg.TargetSelection == "rotate" {
+		return &selectingChecker{
+			targets:  targets,
+			checkers: checkers,
+			weights:  weights,
+			rotate:   cfg.TargetSelection == "rotate",
+			next:     make(map[int]int),
+		}, nil
+	}
+	return &quorumChecker{
+		targets:  targets,
+		checkers: checkers,
+		quorum:   cfg.Quorum,
+	}, nil
+}
+
+// checkLoss returns an error if more than maxLoss percent of the sent echo
+// requests to target went unanswered.
+func checkLoss(target string, sent, received, maxLoss int) error {
+	if sent == 0 {
+		return fmt.Errorf("no echo requests sent to %s", target)
+	}
+	loss := (sent - received) * 100 / sent
+	if received == 0 || loss > maxLoss {
+		return fmt.Errorf("%d%% packet loss to %s (%d of %d received), more than the maximum of %d%%", loss, target, received, sent, maxLoss)
+	}
+	return nil
+}
+
+// defaultCheckIP returns the check IP used if none is configured, a
+// well-known public DNS server in the given netlink address family.
+func defaultCheckIP(family int) netip.Addr {
+	if family == netlink.FAMILY_V6 {
+		return netip.MustParseAddr("2001:4860:4860::8888")
+	}
+	return netip.MustParseAddr("8.8.8.8")
+}
+
+// checkDestination returns the address that checks configured by cfg are
+// sent to, so that the route used for them can be looked up. With multiple
+// methods, the first one's destination is used. If the destination isn't an
+// IP address in the given family (e.g. it's a hostname), defaultCheckIP is
+// returned instead.
+func checkDestination(cfg *CheckConfig, family int) netip.Addr {
+	var hosts []string
+	for _, method := range cfg.methods() {
+		switch method {
+		case "ping", "icmp-native":
+			for _, s := range cfg.IPs {
+				target, _, _ := splitTargetWeight(s)
+				hosts = append(hosts, target)
+			}
+		case "tcp":
+			if host, _, err := net.SplitHostPort(cfg.TCPAddr); err == nil {
+				hosts = append(hosts, host)
+			}
+		case "http":
+			if u, err := url.Parse(cfg.URL); err == nil {
+				hosts = append(hosts, u.Hostname())
+			}
+		case "dns":
+			if host, _, err := net.SplitHostPort(cfg.DNSServer); err == nil {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	for _, host := range hosts {
+		if addr, err := netip.ParseAddr(host); err == nil && familyMatches(addr, family) {
+			return addr.Unmap()
+		}
+	}
+	return defaultCheckIP(family)
+}
+
+// validateHTTPURL returns an error unless s is an http or https URL.
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must be http or https", s)
+	}
+	return nil
+}
+
+// allChecker checks that every one of its checkers passes, in order,
+// stopping at the first failure.
+type allChecker struct {
+	checkers []Checker
+}
+
+func (c *allChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+// CheckRTT returns the round-trip time measured by the first checker that
+// measures it, if any.
+func (c *allChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	var rtt time.Duration
+	for _, checker := range c.checkers {
+		d, err := checkRTT(ctx, checker, iface)
+		if err != nil {
+			return 0, err
+		}
+		if rtt == 0 {
+			rtt = d
+		}
+	}
+	return rtt, nil
+}
+
+// anyChecker checks that at least one of its checkers passes, trying them in
+// order and stopping at the first success.
+type anyChecker struct {
+	checkers []Checker
+}
+
+func (c *anyChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+// CheckRTT returns the round-trip time measured by the checker that passed.
+func (c *anyChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	var errs []string
+	for _, checker := range c.checkers {
+		rtt, err := checkRTT(ctx, checker, iface)
+		if err == nil {
+			return rtt, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return 0, fmt.Errorf("all checks failed: %s", strings.Join(errs, "; "))
+}
+
+// captivePortalChecker wraps an HTTP checker expecting an empty 204 response,
+// so that any other response, such as a redirect or HTML page served by a
+// captive portal, marks the upstream as down.
+type captivePortalChecker struct {
+	*httpChecker
+}
+
+func (c *captivePortalChecker) Check(ctx context.Context, iface *net.Interface) error {
+	if err := c.httpChecker.Check(ctx, iface); err != nil {
+		return fmt.Errorf("captive portal check failed: %w", err)
+	}
+	return nil
+}
+
+type gatewayKey struct{}
+
+// withGateway returns a copy of ctx for checks via the link with gateway gw.
+func withGateway(ctx context.Context, gw netip.Addr) context.Context {
+	return context.WithValue(ctx, gatewayKey{}, gw)
+}
+
+// gatewayFromContext returns the gateway set on ctx by withGateway, if any.
+func gatewayFromContext(ctx context.Context) netip.Addr {
+	gw, _ := ctx.Value(gatewayKey{}).(netip.Addr)
+	return gw
+}
+
+type fwmarkKey struct{}
+
+// withFwmark returns a copy of ctx under which checks set the firewall mark
+// on their sockets to mark, if it's non-zero.
+func withFwmark(ctx context.Context, mark uint32) context.Context {
+	if mark == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, fwmarkKey{}, mark)
+}
+
+// fwmarkFromContext returns the firewall mark set on ctx by withFwmark, or
+// zero if there's none.
+func fwmarkFromContext(ctx context.Context) uint32 {
+	mark, _ := ctx.Value(fwmarkKey{}).(uint32)
+	return mark
+}
+
+// socketControl returns a function suitable for use as a net.Dialer or
+// net.ListenConfig Control function that binds the socket to the named
+// interface with SO_BINDTODEVICE, so that traffic egresses that interface
+// regardless of what the routing table says. It also sets the socket's
+// firewall mark, if ctx has one.
+func socketControl(ctx context.Context, name string) func(network, address string, c syscall.RawConn) error {
+	mark := fwmarkFromContext(ctx)
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setSocketOptions(int(fd), name, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// setSocketOptions binds the socket fd to the named interface, and sets its
+// firewall mark if mark is non-zero.
+func setSocketOptions(fd int, name string, mark uint32) error {
+	if err := syscall.BindToDevice(fd, name); err != nil {
+		return os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+	}
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+			return os.NewSyscallError("setsockopt SO_MARK", err)
+		}
+	}
+	return nil
+}
+
+// interfaceAddr returns the first address in the given netlink address family
+// assigned to iface, for use as the source address of checks. Link-local
+// addresses are skipped, since they can't be used to reach anything beyond
+// the link.
+func interfaceAddr(iface *net.Interface, family int) (netip.Addr, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("getting addresses for %s: %w", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok || !familyMatches(ip, family) {
+			continue
+		}
+		if ip.IsLinkLocalUnicast() {
+			continue
+		}
+		return ip.Unmap(), nil
+	}
+	if family == netlink.FAMILY_V6 {
+		return netip.Addr{}, fmt.Errorf("no global IPv6 address on %s", iface.Name)
+	}
+	return netip.Addr{}, fmt.Errorf("no non-link-local IPv4 address on %s", iface.Name)
+}
@@ -0,0 +1,106 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// errDNSTimeout is returned when the resolver doesn't answer a DNS
+	// check before the check timeout.
+	errDNSTimeout = errors.New("DNS query timed out")
+
+	// errDNSServerFailure is returned when the resolver answers a DNS
+	// check with SERVFAIL.
+	errDNSServerFailure = errors.New("DNS server returned SERVFAIL")
+)
+
+// dnsChecker checks an upstream by resolving a name against a specific DNS
+// server.
+type dnsChecker struct {
+	name    string
+	server  string // host:port
+	family  int
+	ports   portRange
+	timeout time.Duration
+}
+
+func (c *dnsChecker) Check(ctx context.Context, iface *net.Interface) error {
+	src, err := interfaceAddr(iface, c.family)
+	if err != nil {
+		return err
+	}
+
+	name, err := dnsmessage.NewName(c.name)
+	if err != nil {
+		return fmt.Errorf("invalid DNS check name %q: %w", c.name, err)
+	}
+
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	d := net.Dialer{Control: socketControl(ctx, iface.Name)}
+	conn, err := dialFrom(ctx, d, familyNetwork("udp", c.family), c.server, src, c.ports)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return fmt.Errorf("sending DNS query to %s: %w", c.server, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("querying %s for %s: %w", c.server, c.name, errDNSTimeout)
+		} else if err != nil {
+			return fmt.Errorf("reading DNS response from %s: %w", c.server, err)
+		}
+
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil || resp.ID != id || !resp.Response {
+			continue
+		}
+
+		switch resp.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeServerFailure:
+			return fmt.Errorf("querying %s for %s: %w", c.server, c.name, errDNSServerFailure)
+		default:
+			return fmt.Errorf("querying %s for %s: DNS server returned %s", c.server, c.name, strings.TrimPrefix(resp.RCode.String(), "RCode"))
+		}
+		if len(resp.Answers) == 0 {
+			return fmt.Errorf("querying %s for %s: no answers", c.server, c.name)
+		}
+		return nil
+	}
+}
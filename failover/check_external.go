@@ -0,0 +1,110 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// externalCheckTimeout bounds each external check, which may take a while as
+// the service tries to connect back.
+const externalCheckTimeout = 30 * time.Second
+
+// maxExternalCheckBody is the most of the external check service's response
+// that's read.
+const maxExternalCheckBody = 64 << 10
+
+// externalCheckResult is the JSON response of the service at
+// --external-check-url.
+type externalCheckResult struct {
+	// Reachable is whether the service could connect back to us, at the
+	// address the request came from.
+	Reachable *bool `json:"reachable"`
+	// IP is the public address the request came from, if reported.
+	IP string `json:"ip"`
+}
+
+// externalCheck requests url via iface, from its address in the given family,
+// and returns the external service's report of whether it could reach us from
+// outside.
+func externalCheck(ctx context.Context, iface *net.Interface, family int, url string) (externalCheckResult, error) {
+	var res externalCheckResult
+	client, err := interfaceHTTPClient(ctx, iface, family, portRange{}, externalCheckTimeout, nil)
+	if err != nil {
+		return res, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return res, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return res, fmt.Errorf("unexpected HTTP status %d from %s", resp.StatusCode, url)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxExternalCheckBody))
+	if err != nil {
+		return res, fmt.Errorf("reading response body from %s: %w", url, err)
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return res, fmt.Errorf("parsing response from %s: %w", url, err)
+	} else if res.Reachable == nil {
+		return res, fmt.Errorf(`response from %s has no "reachable" field`, url)
+	}
+	return res, nil
+}
+
+// errUnreachableFromOutside is the check error for a link that the external
+// check service reports it can't reach us via.
+var errUnreachableFromOutside = errors.New("external check reports inbound connections failing")
+
+// checkExternal asks the external check service whether it can reach us via
+// l, if it's configured and a check is due, and returns an error if the
+// latest answer was that it can't, so that outbound traffic working doesn't
+// hide inbound traffic being broken. A check that fails is logged, but
+// doesn't count against the link, since the check proper catches outages.
+func (m *monitor) checkExternal(ctx context.Context, l *link) error {
+	cfg := &m.cfg.Check
+	if cfg.ExternalCheckURL == "" {
+		return nil
+	}
+
+	if l.externalTried.IsZero() || time.Since(l.externalTried) >= cfg.ExternalCheckInterval {
+		l.externalTried = time.Now()
+		res, err := externalCheck(ctx, l.iface, m.family, cfg.ExternalCheckURL)
+		switch {
+		case err != nil:
+			m.log.Warn("error doing external check", "event", "external_check", "interface", l.iface.Name, "url", cfg.ExternalCheckURL, "error", err)
+		case *res.Reachable:
+			m.log.Debug("external check succeeded", "event", "external_check", "interface", l.iface.Name, "public_ip", res.IP)
+		default:
+			m.log.Warn("external check can't reach us via interface", "event", "external_check", "interface", l.iface.Name, "public_ip", res.IP)
+		}
+		if err == nil {
+			reachable := 0.0
+			if *res.Reachable {
+				reachable = 1
+			}
+			metricInboundReachable.WithLabelValues(l.iface.Name).Set(reachable)
+			m.mu.Lock()
+			l.inbound = *res.Reachable
+			l.hasInbound = true
+			l.publicIP = res.IP
+			m.mu.Unlock()
+		}
+	}
+
+	if l.hasInbound && !l.inbound {
+		return errUnreachableFromOutside
+	}
+	return nil
+}
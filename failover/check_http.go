@@ -0,0 +1,130 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxCheckBodySize is the most we'll read of an HTTP check response when
+// looking for the expected body substring.
+const maxCheckBodySize = 1 << 20
+
+// interfaceHTTPClient returns an HTTP client whose requests go via iface,
+// from its address in the given family and a port in ports, and time out
+// after timeout. If proxy isn't nil, they're made through it, connecting to it
+// via iface.
+func interfaceHTTPClient(ctx context.Context, iface *net.Interface, family int, ports portRange, timeout time.Duration, proxy *url.URL) (*http.Client, error) {
+	src, err := interfaceAddr(iface, family)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Control: socketControl(ctx, iface.Name)}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialFrom(ctx, d, familyNetwork("tcp", family), addr, src, ports)
+			},
+			Proxy:               http.ProxyURL(proxy),
+			TLSHandshakeTimeout: timeout,
+			DisableKeepAlives:   true,
+		},
+	}, nil
+}
+
+// parseProxyURL parses s, the URL of an HTTP(S) or SOCKS5 proxy, or returns
+// nil if it's empty.
+func parseProxyURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%q must be http, https, socks5 or socks5h", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", s)
+	}
+	return u, nil
+}
+
+// httpChecker checks an upstream by making an HTTP(S) GET request and
+// verifying the response.
+type httpChecker struct {
+	url          string
+	expectStatus int    // if zero, any 2xx status is accepted
+	expectBody   string // if non-empty, must appear in the response body
+	expectEmpty  bool   // if set, the response body must be empty
+	maxRedirects int
+	proxy        *url.URL // if not nil, the proxy to make the request through
+	family       int
+	ports        portRange
+	timeout      time.Duration
+}
+
+func (c *httpChecker) Check(ctx context.Context, iface *net.Interface) error {
+	client, err := interfaceHTTPClient(ctx, iface, c.family, c.ports, c.timeout, c.proxy)
+	if err != nil {
+		return err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if c.maxRedirects == 0 {
+			return fmt.Errorf("redirected to %s", req.URL)
+		}
+		if len(via) > c.maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", c.maxRedirects)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if c.expectStatus != 0 {
+		if resp.StatusCode != c.expectStatus {
+			return fmt.Errorf("unexpected HTTP status %d from %s, wanted %d", resp.StatusCode, c.url, c.expectStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %d from %s", resp.StatusCode, c.url)
+	}
+
+	if c.expectEmpty {
+		n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxCheckBodySize))
+		if err != nil {
+			return fmt.Errorf("reading response body from %s: %w", c.url, err)
+		} else if n > 0 {
+			return fmt.Errorf("unexpected %d-byte response body from %s", n, c.url)
+		}
+		return nil
+	}
+	if c.expectBody == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBodySize))
+	if err != nil {
+		return fmt.Errorf("reading response body from %s: %w", c.url, err)
+	}
+	if !bytes.Contains(body, []byte(c.expectBody)) {
+		return fmt.Errorf("expected body substring %q not found in response from %s", c.expectBody, c.url)
+	}
+	return nil
+}
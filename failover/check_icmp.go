@@ -0,0 +1,306 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolICMPIPv6 = 58
+)
+
+// maxPingSize is the largest echo request payload that fits in an IPv4
+// packet, as with ping -s.
+const maxPingSize = 65507
+
+// defaultPingPayload is the payload of native echo requests, repeated to fill
+// the payload size if one is given.
+const defaultPingPayload = "gateway-failover"
+
+// icmpChecker checks an upstream by sending it an ICMP echo request directly,
+// rather than via the ping binary.
+type icmpChecker struct {
+	target  netip.Addr
+	timeout time.Duration // per echo request
+	count   int
+	maxLoss int // percent
+	// size and tos, if non-zero, are the payload size and TOS byte of
+	// the echo requests.
+	size int
+	tos  int
+}
+
+func (c *icmpChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+// CheckRTT sends c.count echo requests one after another, or as many as it
+// can before ctx is done, e.g. at the ping deadline, and returns the mean
+// round-trip time of those that were answered.
+func (c *icmpChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	if c.count <= 1 {
+		rtt, err := pingNative(ctx, iface, c.target, c.timeout, c.size, c.tos)
+		if err != nil {
+			return 0, err
+		}
+		slog.Log(ctx, levelTrace, "ICMP echo reply", "event", "check_target", "interface", iface.Name, "target", c.target, "rtt", rtt)
+		return rtt, nil
+	}
+
+	var (
+		sent, received int
+		total          time.Duration
+		lastErr        error
+	)
+	for i := 0; i < c.count && ctx.Err() == nil; i++ {
+		sent++
+		rtt, err := pingNative(ctx, iface, c.target, c.timeout, c.size, c.tos)
+		if err != nil {
+			slog.Log(ctx, levelTrace, "no ICMP echo reply", "event", "check_target", "interface", iface.Name, "target", c.target, "seq", i, "error", err)
+			lastErr = err
+			continue
+		}
+		slog.Log(ctx, levelTrace, "ICMP echo reply", "event", "check_target", "interface", iface.Name, "target", c.target, "seq", i, "rtt", rtt)
+		received++
+		total += rtt
+	}
+	if err := checkLoss(c.target.String(), sent, received, c.maxLoss); err != nil {
+		if lastErr != nil {
+			err = fmt.Errorf("%w; last error: %v", err, lastErr)
+		}
+		return 0, err
+	}
+	return total / time.Duration(received), nil
+}
+
+// gatewayChecker checks that the gateway of the link being checked, from
+// withGateway, answers ICMP echo requests, as a quick local liveness test.
+type gatewayChecker struct {
+	timeout time.Duration
+	count   int
+	maxLoss int // percent
+}
+
+func (c *gatewayChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+func (c *gatewayChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	gw := gatewayFromContext(ctx)
+	if !gw.IsValid() {
+		return 0, fmt.Errorf("no gateway known for %s", iface.Name)
+	}
+	ic := &icmpChecker{target: gw, timeout: c.timeout, count: c.count, maxLoss: c.maxLoss}
+	rtt, err := ic.CheckRTT(ctx, iface)
+	if err != nil {
+		return 0, fmt.Errorf("gateway %v: %w", gw, err)
+	}
+	return rtt, nil
+}
+
+// pingNative sends a single ICMP echo request to dst out of iface and waits
+// up to timeout for the matching reply, returning the round-trip time. If
+// they're non-zero, size is the request's payload size and tos its TOS byte.
+func pingNative(ctx context.Context, iface *net.Interface, dst netip.Addr, timeout time.Duration, size, tos int) (time.Duration, error) {
+	family := netlink.FAMILY_V4
+	if dst.Is6() {
+		family = netlink.FAMILY_V6
+	}
+
+	src, err := interfaceAddr(iface, family)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, raw, err := listenICMP(ctx, iface, src)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if tos != 0 {
+		if err := setTOS(conn, family, tos); err != nil {
+			return 0, err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	// For unprivileged datagram sockets the kernel overwrites the ID with
+	// the socket's "port", so only the sequence number is meaningful.
+	id := os.Getpid() & 0xffff
+	seq := int(time.Now().UnixNano() & 0xffff)
+	var (
+		echoType  icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		proto               = protocolICMP
+	)
+	if family == netlink.FAMILY_V6 {
+		echoType = ipv6.ICMPTypeEchoRequest
+		replyType = ipv6.ICMPTypeEchoReply
+		proto = protocolICMPIPv6
+	}
+
+	// The checksum is left zero for ICMPv6; the kernel computes it for us.
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: pingPayload(size),
+		},
+	}
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// A link-local destination, such as a gateway, is only meaningful on
+	// iface.
+	var zone string
+	if dst.IsLinkLocalUnicast() {
+		zone = iface.Name
+	}
+	var addr net.Addr = &net.IPAddr{IP: dst.AsSlice(), Zone: zone}
+	if !raw {
+		addr = &net.UDPAddr{IP: dst.AsSlice(), Zone: zone}
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(wb, addr); err != nil {
+		return 0, fmt.Errorf("sending ICMP echo to %v: %w", dst, err)
+	}
+
+	// Leave room for the ICMP header along with the payload.
+	rb := make([]byte, max(1500, size+8))
+	for {
+		n, _, err := conn.ReadFrom(rb)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("no ICMP echo reply from %v within %v", dst, deadline.Sub(start).Round(time.Millisecond))
+		} else if err != nil {
+			return 0, fmt.Errorf("reading ICMP reply from %v: %w", dst, err)
+		}
+
+		reply, err := icmp.ParseMessage(proto, rb[:n])
+		if err != nil {
+			continue
+		}
+		if reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (raw && echo.ID != id) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+// pingPayload returns the payload for a native echo request of the given
+// size, or the default one if it's zero.
+func pingPayload(size int) []byte {
+	if size == 0 {
+		return []byte(defaultPingPayload)
+	}
+	return []byte(strings.Repeat(defaultPingPayload, size/len(defaultPingPayload)+1)[:size])
+}
+
+// setTOS sets the TOS byte, or for IPv6 the traffic class, of the packets
+// sent on conn.
+func setTOS(conn net.PacketConn, family, tos int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't set TOS on %T", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt, name := syscall.IPPROTO_IP, syscall.IP_TOS, "IP_TOS"
+	if family == netlink.FAMILY_V6 {
+		level, opt, name = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, "IPV6_TCLASS"
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, tos)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return os.NewSyscallError("setsockopt "+name, serr)
+	}
+	return nil
+}
+
+// listenICMP opens an ICMP socket bound to iface and src, with the firewall
+// mark from ctx, if any. A raw socket is preferred; if we lack CAP_NET_RAW,
+// an unprivileged datagram ICMP socket is tried instead. The returned bool
+// reports whether the socket is raw.
+func listenICMP(ctx context.Context, iface *net.Interface, src netip.Addr) (net.PacketConn, bool, error) {
+	network := "ip4:icmp"
+	if src.Is6() {
+		network = "ip6:ipv6-icmp"
+	}
+
+	lc := net.ListenConfig{Control: socketControl(ctx, iface.Name)}
+	conn, err := lc.ListenPacket(context.Background(), network, src.String())
+	if err == nil {
+		return conn, true, nil
+	} else if !errors.Is(err, os.ErrPermission) {
+		return nil, false, fmt.Errorf("opening raw ICMP socket: %w", err)
+	}
+
+	conn, err = listenICMPDatagram(iface, src, fwmarkFromContext(ctx))
+	if errors.Is(err, os.ErrPermission) {
+		return nil, false, fmt.Errorf("native ICMP check requires CAP_NET_RAW, or net.ipv4.ping_group_range to include this process's group: %w", err)
+	} else if err != nil {
+		return nil, false, fmt.Errorf("opening datagram ICMP socket: %w", err)
+	}
+	return conn, false, nil
+}
+
+func listenICMPDatagram(iface *net.Interface, src netip.Addr, mark uint32) (net.PacketConn, error) {
+	domain, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{Addr: src.As4()}
+	if src.Is6() {
+		domain, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa = &syscall.SockaddrInet6{Addr: src.As16()}
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+
+	if err := setSocketOptions(fd, iface.Name, mark); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return net.FilePacketConn(f)
+}
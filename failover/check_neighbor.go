@@ -0,0 +1,164 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// neighborPollInterval is how often neighborChecker looks at the neighbor
+// table while waiting for the kernel to resolve the gateway.
+const neighborPollInterval = 100 * time.Millisecond
+
+// neighborUsable are the neighbor entry states in which the gateway is
+// known to be reachable at L2.
+const neighborUsable = netlink.NUD_REACHABLE | netlink.NUD_PERMANENT | netlink.NUD_NOARP
+
+// neighborChecker checks that the gateway of the link being checked, from
+// withGateway, has a valid entry in the interface's neighbor table (ARP for
+// IPv4, or NDP for IPv6), as a quick and definitive local test.
+//
+// An entry that's been confirmed recently passes. One that the kernel is
+// revalidating, or will be once it's next used, also passes, but is sent a
+// packet to make sure it gets revalidated, after which it's REACHABLE or
+// FAILED. Otherwise, with no entry or a FAILED one, a packet is sent to make
+// the kernel resolve the gateway, and the check passes if it does so within
+// the timeout.
+type neighborChecker struct {
+	timeout time.Duration
+}
+
+func (c *neighborChecker) Check(ctx context.Context, iface *net.Interface) error {
+	gw := gatewayFromContext(ctx)
+	if !gw.IsValid() {
+		return fmt.Errorf("no gateway known for %s", iface.Name)
+	}
+
+	state, err := neighborState(iface, gw)
+	if err != nil {
+		return err
+	}
+	switch {
+	case state&neighborUsable != 0:
+		return nil
+	case state&(netlink.NUD_STALE|netlink.NUD_DELAY|netlink.NUD_PROBE) != 0:
+		return probeNeighbor(ctx, iface, gw)
+	}
+
+	if err := probeNeighbor(ctx, iface, gw); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(c.timeout)
+	ticker := time.NewTicker(neighborPollInterval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gateway %v: neighbor entry is %s: %w", gw, neighborStateName(state), ctx.Err())
+		case <-ticker.C:
+		}
+		if state, err = neighborState(iface, gw); err != nil {
+			return err
+		} else if state&neighborUsable != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %v: neighbor entry is %s after %v", gw, neighborStateName(state), c.timeout)
+}
+
+// verifyGateway returns an error if l's gateway can't be resolved by ARP or
+// NDP within the check timeout, with VerifyGateway, before switching to it.
+// Interfaces without neighbors, and simulated checks, aren't verified.
+func (m *monitor) verifyGateway(l *link) error {
+	if !m.cfg.VerifyGateway || m.sim != nil || !hasNeighbors(l.iface) {
+		return nil
+	}
+	timeout := m.cfg.Check.Timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c := &neighborChecker{timeout: timeout}
+	return c.Check(withGateway(withFwmark(ctx, l.fwmark), l.gw), l.iface)
+}
+
+// hasNeighbors reports whether iface resolves its neighbors' link-layer
+// addresses, unlike e.g. point-to-point, tunnel and NOARP interfaces, which
+// have no neighbor table entries to check.
+func hasNeighbors(iface *net.Interface) bool {
+	if iface.Flags&net.FlagPointToPoint != 0 || len(iface.HardwareAddr) == 0 {
+		return false
+	}
+	link, err := nl.LinkByIndex(iface.Index)
+	return err != nil || link.Attrs().RawFlags&unix.IFF_NOARP == 0
+}
+
+// neighborState returns the state of gw's entry in iface's neighbor table, or
+// NUD_NONE if there's none.
+func neighborState(iface *net.Interface, gw netip.Addr) (int, error) {
+	family := netlink.FAMILY_V4
+	if gw.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	neighs, err := nl.NeighList(iface.Index, family)
+	if err != nil {
+		return 0, fmt.Errorf("listing neighbors of %s: %w", iface.Name, err)
+	}
+	for _, n := range neighs {
+		if ip, ok := netip.AddrFromSlice(n.IP); ok && ip.Unmap() == gw {
+			return n.State, nil
+		}
+	}
+	return netlink.NUD_NONE, nil
+}
+
+// probeNeighbor sends a UDP datagram to the discard port on gw out of iface,
+// to make the kernel resolve or revalidate gw's neighbor entry.
+func probeNeighbor(ctx context.Context, iface *net.Interface, gw netip.Addr) error {
+	family := netlink.FAMILY_V4
+	if gw.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	src, err := interfaceAddr(iface, family)
+	if err != nil {
+		return err
+	}
+	dst := gw
+	if dst.IsLinkLocalUnicast() {
+		dst = dst.WithZone(iface.Name)
+	}
+
+	d := &net.Dialer{
+		LocalAddr: &net.UDPAddr{IP: src.AsSlice()},
+		Control:   socketControl(ctx, iface.Name),
+	}
+	conn, err := d.DialContext(ctx, familyNetwork("udp", family), netip.AddrPortFrom(dst, 9).String())
+	if err != nil {
+		return fmt.Errorf("probing gateway %v: %w", gw, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return fmt.Errorf("probing gateway %v: %w", gw, err)
+	}
+	return nil
+}
+
+// neighborStateName returns the name of a neighbor entry state, as shown by
+// ip-neighbour(8).
+func neighborStateName(state int) string {
+	names := []string{"INCOMPLETE", "REACHABLE", "STALE", "DELAY", "PROBE", "FAILED", "NOARP", "PERMANENT"}
+	var ret []string
+	for i, name := range names {
+		if state&(1<<i) != 0 {
+			ret = append(ret, name)
+		}
+	}
+	if len(ret) == 0 {
+		return "missing"
+	}
+	return strings.Join(ret, ",")
+}
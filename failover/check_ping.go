@@ -0,0 +1,187 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// defaultPingArgs is the default --ping-args template. Passing ping the
+// interface name makes iputils and busybox ping bind to the interface, so
+// that probes egress it even while it isn't carrying the default route.
+const defaultPingArgs = "-{family} -I {interface} -c {count} {target}"
+
+// pingChecker checks an upstream by running the system ping binary.
+//
+// A template that passes ping iface's address, with "{source}", rather than
+// its name only sets the probe's source address; for probes to egress iface
+// while it isn't carrying the default route, the kernel must then route its
+// address out of it, e.g. with a policy routing rule.
+type pingChecker struct {
+	path    string
+	args    []string // template; see expandPingArgs
+	target  string
+	family  int
+	count   int
+	maxLoss int // percent
+}
+
+func (c *pingChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+// CheckRTT returns the round-trip time parsed from ping's output, or zero if
+// it can't be found. If more than one echo request is sent, the packet loss
+// is taken from ping's summary, and a missing summary is an error.
+//
+// With a count and -w deadline, iputils ping exits with status 1 if fewer
+// than count replies arrive in time, so that status fails the check only if
+// there were no replies at all; otherwise, it's up to checkLoss.
+func (c *pingChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	src, err := interfaceAddr(iface, c.family)
+	if err != nil {
+		return 0, err
+	}
+	out, err := runPing(ctx, c.path, expandPingArgs(c.args, c.family, src, iface.Name, c.count, c.target))
+	if err != nil {
+		var exitErr *exec.ExitError
+		_, received, ok := parsePingLoss(out)
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || !ok || received == 0 {
+			return 0, err
+		}
+	}
+	if c.count > 1 {
+		sent, received, ok := parsePingLoss(out)
+		if !ok {
+			return 0, fmt.Errorf("no packet loss summary in ping output: %s", strings.TrimSpace(string(out)))
+		}
+		if err := checkLoss(c.target, sent, received, c.maxLoss); err != nil {
+			return 0, err
+		}
+	}
+	rtt := parsePingRTT(out)
+	slog.Log(ctx, levelTrace, "ping reply", "event", "check_target", "interface", iface.Name, "target", c.target, "rtt", rtt)
+	return rtt, nil
+}
+
+var (
+	// pingTimeRE matches the round-trip time in a reply line of ping's
+	// output, e.g. "64 bytes from 8.8.8.8: icmp_seq=1 ttl=117 time=10.3 ms".
+	pingTimeRE = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+
+	// pingAvgRE matches the mean round-trip time in ping's summary, e.g.
+	// "rtt min/avg/max/mdev = 9.1/10.3/11.8/0.9 ms" from iputils, or
+	// "round-trip min/avg/max = 9.1/10.3/11.8 ms" from busybox.
+	pingAvgRE = regexp.MustCompile(`min/avg/max\S* = [0-9.]+/([0-9.]+)/`)
+
+	// pingLossRE matches the packet counts in ping's summary, e.g. "5
+	// packets transmitted, 4 received" or "5 packets transmitted, 4
+	// packets received".
+	pingLossRE = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+)
+
+// parsePingRTT returns the round-trip time from ping's output, preferring
+// the mean from its summary, or zero if there's none.
+func parsePingRTT(out []byte) time.Duration {
+	m := pingAvgRE.FindSubmatch(out)
+	if m == nil {
+		m = pingTimeRE.FindSubmatch(out)
+	}
+	if m == nil {
+		return 0
+	}
+	ms, err := strconv.ParseFloat(string(m[1]), 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// parsePingLoss returns the number of echo requests sent and replies
+// received from ping's summary, and whether it was found.
+func parsePingLoss(out []byte) (sent, received int, ok bool) {
+	m := pingLossRE.FindSubmatch(out)
+	if m == nil {
+		return 0, 0, false
+	}
+	sent, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return 0, 0, false
+	}
+	received, err = strconv.Atoi(string(m[2]))
+	if err != nil {
+		return 0, 0, false
+	}
+	return sent, received, true
+}
+
+// expandPingArgs returns the ping arguments from the template args, replacing
+// "{family}" with 4 or 6, "{source}" with src, "{interface}" with iface,
+// "{count}" with count, and "{target}" with target.
+func expandPingArgs(args []string, family int, src netip.Addr, iface string, count int, target string) []string {
+	r := strings.NewReplacer(
+		"{family}", strconv.Itoa(ipVersion(family)),
+		"{source}", src.String(),
+		"{interface}", iface,
+		"{count}", strconv.Itoa(count),
+		"{target}", target,
+	)
+	ret := make([]string, len(args))
+	for i, arg := range args {
+		ret[i] = r.Replace(arg)
+	}
+	return ret
+}
+
+// runPing runs the ping binary at path with args, and returns its output,
+// even if it fails.
+func runPing(ctx context.Context, path string, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		cmdline := strings.Join(append([]string{path}, args...), " ")
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return out, fmt.Errorf("%s: %w; output: %s", cmdline, err, msg)
+		}
+		return out, fmt.Errorf("%s: %w", cmdline, err)
+	}
+	return out, nil
+}
+
+// probePing checks that the ping binary at path exists and accepts the
+// arguments in the template args, by pinging the loopback address.
+func probePing(path string, args []string, family int) error {
+	if _, err := exec.LookPath(path); err != nil {
+		return err
+	}
+
+	lo := netip.MustParseAddr("127.0.0.1")
+	if family == netlink.FAMILY_V6 {
+		lo = netip.IPv6Loopback()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := runPing(ctx, path, expandPingArgs(args, family, lo, "lo", 1, lo.String()))
+	return err
+}
+
+// hasTargetArg reports whether any of args includes the {target} placeholder.
+func hasTargetArg(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "{target}") {
+			return true
+		}
+	}
+	return false
+}
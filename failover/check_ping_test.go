@@ -0,0 +1,260 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestExpandPingArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   string
+		family int
+		src    string
+		count  int
+		target string
+		want   string
+	}{
+		{
+			name:   "default",
+			args:   defaultPingArgs,
+			family: netlink.FAMILY_V4,
+			src:    "192.0.2.10",
+			count:  1,
+			target: "8.8.8.8",
+			want:   "-4 -I eth0 -c 1 8.8.8.8",
+		},
+		{
+			name:   "default ipv6",
+			args:   defaultPingArgs,
+			family: netlink.FAMILY_V6,
+			src:    "2001:db8::10",
+			count:  5,
+			target: "2001:4860:4860::8888",
+			want:   "-6 -I eth0 -c 5 2001:4860:4860::8888",
+		},
+		{
+			name:   "source",
+			args:   "-I {source} -W 2 {target}",
+			family: netlink.FAMILY_V4,
+			src:    "192.0.2.10",
+			target: "8.8.8.8",
+			want:   "-I 192.0.2.10 -W 2 8.8.8.8",
+		},
+		{
+			// Placeholders are replaced within arguments, too.
+			name:   "within arguments",
+			args:   "--interface={interface} -{family} -c{count} {target}",
+			family: netlink.FAMILY_V4,
+			src:    "192.0.2.10",
+			count:  3,
+			target: "8.8.8.8",
+			want:   "--interface=eth0 -4 -c3 8.8.8.8",
+		},
+	}
+	for _, tt := range tests {
+		got := expandPingArgs(strings.Fields(tt.args), tt.family, netip.MustParseAddr(tt.src), "eth0", tt.count, tt.target)
+		if want := strings.Fields(tt.want); !slices.Equal(got, want) {
+			t.Errorf("%s: expandPingArgs(%q) = %q; want %q", tt.name, tt.args, got, want)
+		}
+	}
+}
+
+func TestParsePingRTT(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want time.Duration
+	}{
+		{
+			name: "iputils",
+			out: `PING 8.8.8.8 (8.8.8.8) from 192.0.2.10 eth0: 56(84) bytes of data.
+64 bytes from 8.8.8.8: icmp_seq=1 ttl=117 time=10.3 ms
+
+--- 8.8.8.8 ping statistics ---
+1 packets transmitted, 1 received, 0% packet loss, time 0ms
+rtt min/avg/max/mdev = 10.312/10.312/10.312/0.000 ms
+`,
+			want: 10312 * time.Microsecond,
+		},
+		{
+			name: "busybox summary",
+			out: `64 bytes from 8.8.8.8: seq=0 ttl=117 time=9.1 ms
+64 bytes from 8.8.8.8: seq=1 ttl=117 time=11.5 ms
+
+--- 8.8.8.8 ping statistics ---
+2 packets transmitted, 2 packets received, 0% packet loss
+round-trip min/avg/max = 9.1/10.3/11.5 ms
+`,
+			want: 10300 * time.Microsecond,
+		},
+		{
+			name: "busybox",
+			out: `PING 8.8.8.8 (8.8.8.8): 56 data bytes
+64 bytes from 8.8.8.8: seq=0 ttl=117 time=9.871 ms
+`,
+			want: 9871 * time.Microsecond,
+		},
+		{
+			name: "sub-millisecond",
+			out:  "64 bytes from 192.0.2.1: icmp_seq=1 ttl=64 time<1ms\n",
+			want: time.Millisecond,
+		},
+		{
+			name: "no reply",
+			out:  "1 packets transmitted, 0 received, 100% packet loss, time 0ms\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePingRTT([]byte(tt.out)); got != tt.want {
+				t.Errorf("parsePingRTT = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePingLoss(t *testing.T) {
+	tests := []struct {
+		name           string
+		out            string
+		sent, received int
+		ok             bool
+	}{
+		{
+			name: "iputils",
+			out:  "5 packets transmitted, 4 received, 20% packet loss, time 4005ms\n",
+			sent: 5, received: 4, ok: true,
+		},
+		{
+			name: "iputils with errors",
+			out:  "5 packets transmitted, 0 received, +5 errors, 100% packet loss, time 4080ms\n",
+			sent: 5, received: 0, ok: true,
+		},
+		{
+			name: "busybox",
+			out:  "3 packets transmitted, 3 packets received, 0% packet loss\n",
+			sent: 3, received: 3, ok: true,
+		},
+		{
+			name: "no summary",
+			out:  "ping: sendmsg: Network is unreachable\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, received, ok := parsePingLoss([]byte(tt.out))
+			if sent != tt.sent || received != tt.received || ok != tt.ok {
+				t.Errorf("parsePingLoss = %d, %d, %v; want %d, %d, %v", sent, received, ok, tt.sent, tt.received, tt.ok)
+			}
+		})
+	}
+}
+
+// fakePing writes a script that prints out and exits with the given status,
+// in place of ping, and returns its path.
+func fakePing(t *testing.T, out string, status int) string {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("no shell to run a fake ping with: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ping")
+	script := fmt.Sprintf("#!%s\ncat <<'EOF'\n%sEOF\nexit %d\n", sh, out, status)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPingCheckRTT(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	const rtt = "rtt min/avg/max/mdev = 9.1/10.3/11.8/0.9 ms\n"
+
+	tests := []struct {
+		name   string
+		out    string
+		status int
+		// want is the round-trip time returned, and wantErr part of
+		// the error, if there should be one.
+		want    time.Duration
+		wantErr string
+	}{
+		{
+			name: "all replies",
+			out:  "5 packets transmitted, 5 received, 0% packet loss, time 4005ms\n" + rtt,
+			want: 10300 * time.Microsecond,
+		},
+		{
+			// With -w, iputils ping exits with status 1 if any replies
+			// are missing, which is up to --max-loss.
+			name:   "some replies missing",
+			out:    "5 packets transmitted, 4 received, 20% packet loss, time 4005ms\n" + rtt,
+			status: 1,
+			want:   10300 * time.Microsecond,
+		},
+		{
+			name:    "too many replies missing",
+			out:     "5 packets transmitted, 1 received, 80% packet loss, time 4005ms\n" + rtt,
+			status:  1,
+			wantErr: "80% packet loss",
+		},
+		{
+			name:    "no replies",
+			out:     "5 packets transmitted, 0 received, 100% packet loss, time 4080ms\n",
+			status:  1,
+			wantErr: "exit status 1",
+		},
+		{
+			name:    "no summary",
+			out:     "ping: sendmsg: Network is unreachable\n",
+			status:  1,
+			wantErr: "exit status 1",
+		},
+		{
+			name:    "other failure",
+			out:     "5 packets transmitted, 4 received, 20% packet loss, time 4005ms\n",
+			status:  2,
+			wantErr: "exit status 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &pingChecker{
+				path:    fakePing(t, tt.out, tt.status),
+				args:    strings.Fields(defaultPingArgs),
+				target:  "192.0.2.1",
+				family:  netlink.FAMILY_V4,
+				count:   5,
+				maxLoss: 50,
+			}
+			got, err := c.CheckRTT(context.Background(), lo)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("CheckRTT error = %v; want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckRTT: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CheckRTT = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
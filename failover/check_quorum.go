@@ -0,0 +1,64 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quorumChecker runs a Checker per target concurrently, and considers the
+// upstream healthy if at least quorum of them succeed. Its round-trip time is
+// the mean of those measured by the successful checks.
+type quorumChecker struct {
+	targets  []string
+	checkers []Checker // parallel to targets
+	quorum   int
+}
+
+func (c *quorumChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+func (c *quorumChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	errs := make([]error, len(c.checkers))
+	rtts := make([]time.Duration, len(c.checkers))
+
+	var wg sync.WaitGroup
+	for i, checker := range c.checkers {
+		wg.Add(1)
+		go func(i int, checker Checker) {
+			defer wg.Done()
+			rtts[i], errs[i] = checkRTT(ctx, checker, iface)
+		}(i, checker)
+	}
+	wg.Wait()
+
+	var (
+		failed []string
+		total  time.Duration
+		n      int
+	)
+	for i, err := range errs {
+		if err != nil {
+			slog.Log(ctx, levelTrace, "check target failed", "event", "check_target", "interface", iface.Name, "target", c.targets[i], "error", err)
+			failed = append(failed, c.targets[i])
+		} else if rtts[i] > 0 {
+			total += rtts[i]
+			n++
+		}
+	}
+
+	if ok := len(c.checkers) - len(failed); ok < c.quorum {
+		return 0, fmt.Errorf("only %d of %d check targets reachable, need %d; failed: %s",
+			ok, len(c.checkers), c.quorum, strings.Join(failed, ", "))
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return total / time.Duration(n), nil
+}
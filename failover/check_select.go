@@ -0,0 +1,78 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selectingChecker checks just one of its targets each time, chosen at
+// random in proportion to their weights, or with rotate, in turn, each being
+// checked weight times in a row, so that one target's outage or rate
+// limiting fails only some of the checks, rather than biasing all of them.
+// With rotate, each interface goes through the targets separately.
+type selectingChecker struct {
+	targets  []string
+	checkers []Checker // parallel to targets
+	weights  []int     // parallel to targets
+	rotate   bool
+
+	mu   sync.Mutex
+	next map[int]int // by interface index, with rotate
+}
+
+func (c *selectingChecker) Check(ctx context.Context, iface *net.Interface) error {
+	_, err := c.CheckRTT(ctx, iface)
+	return err
+}
+
+func (c *selectingChecker) CheckRTT(ctx context.Context, iface *net.Interface) (time.Duration, error) {
+	i := c.choose(iface)
+	slog.Debug("check target chosen", "event", "check_target", "interface", iface.Name, "target", c.targets[i])
+	return checkRTT(ctx, c.checkers[i], iface)
+}
+
+// choose returns the index of the target to check via iface next.
+func (c *selectingChecker) choose(iface *net.Interface) int {
+	total := 0
+	for _, w := range c.weights {
+		total += w
+	}
+	var n int
+	if c.rotate {
+		c.mu.Lock()
+		n = c.next[iface.Index]
+		c.next[iface.Index] = (n + 1) % total
+		c.mu.Unlock()
+	} else {
+		n = rand.Intn(total)
+	}
+	for i, w := range c.weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(c.weights) - 1
+}
+
+// splitTargetWeight splits a check IP given as "target=weight", for
+// --check-target-selection=random or rotate, into the target and its weight,
+// which is 1 if not given.
+func splitTargetWeight(s string) (target string, weight int, err error) {
+	target, w, ok := strings.Cut(s, "=")
+	if !ok {
+		return s, 1, nil
+	}
+	weight, err = strconv.Atoi(w)
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("invalid weight %q for check IP %s; must be a positive integer", w, target)
+	}
+	return target, weight, nil
+}
@@ -0,0 +1,31 @@
+package failover
+
+import "testing"
+
+func TestSplitTargetWeight(t *testing.T) {
+	tests := []struct {
+		in     string
+		target string
+		weight int
+		ok     bool
+	}{
+		{"8.8.8.8", "8.8.8.8", 1, true},
+		{"8.8.8.8=3", "8.8.8.8", 3, true},
+		{"2001:4860:4860::8888=2", "2001:4860:4860::8888", 2, true},
+		{"[2001:4860:4860::8888]:53=2", "[2001:4860:4860::8888]:53", 2, true},
+		{"8.8.8.8=0", "", 0, false},
+		{"8.8.8.8=-1", "", 0, false},
+		{"8.8.8.8=heavy", "", 0, false},
+		{"8.8.8.8=", "", 0, false},
+	}
+	for _, tt := range tests {
+		target, weight, err := splitTargetWeight(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("splitTargetWeight(%q) error = %v; want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if target != tt.target || weight != tt.weight {
+			t.Errorf("splitTargetWeight(%q) = %q, %d; want %q, %d", tt.in, target, weight, tt.target, tt.weight)
+		}
+	}
+}
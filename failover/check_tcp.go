@@ -0,0 +1,38 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpChecker checks an upstream by opening a TCP connection to it.
+type tcpChecker struct {
+	addr    string // host:port
+	family  int
+	ports   portRange
+	timeout time.Duration
+}
+
+func (c *tcpChecker) Check(ctx context.Context, iface *net.Interface) error {
+	src, err := interfaceAddr(iface, c.family)
+	if err != nil {
+		return err
+	}
+
+	d := net.Dialer{
+		Timeout: c.timeout,
+		Control: socketControl(ctx, iface.Name),
+	}
+	conn, err := dialFrom(ctx, d, familyNetwork("tcp", c.family), c.addr, src, c.ports)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// The remote host answered with a RST, so it's reachable even
+		// though nothing is listening.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return conn.Close()
+}
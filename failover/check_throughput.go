@@ -0,0 +1,87 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// throughputTimeout bounds each throughput measurement. A download
+	// that's still going when it expires is measured up to that point,
+	// since a slow link is what's being looked for.
+	throughputTimeout = 30 * time.Second
+
+	// maxThroughputBytes is the most that's downloaded per measurement.
+	maxThroughputBytes = 100 << 20
+)
+
+// measureThroughput downloads url via iface, from its address in the given
+// family, and returns the throughput in megabits per second. It's timed from
+// receiving the response headers, so that setting up the connection isn't
+// counted.
+func measureThroughput(ctx context.Context, iface *net.Interface, family int, url string) (float64, error) {
+	client, err := interfaceHTTPClient(ctx, iface, family, portRange{}, throughputTimeout, nil)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("unexpected HTTP status %d from %s", resp.StatusCode, url)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxThroughputBytes))
+	elapsed := time.Since(start)
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil && n > 0) {
+		return 0, fmt.Errorf("reading response body from %s: %w", url, err)
+	} else if n == 0 {
+		return 0, fmt.Errorf("empty response body from %s", url)
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, nil
+}
+
+// checkThroughput measures the download throughput via l, if the throughput
+// check is configured and a measurement is due, and returns an error if the
+// latest measurement is below the minimum. A measurement that fails is
+// logged, but doesn't count against the link, since the check proper catches
+// outages.
+func (m *monitor) checkThroughput(ctx context.Context, l *link) error {
+	cfg := &m.cfg.Check
+	if cfg.ThroughputURL == "" {
+		return nil
+	}
+
+	if l.throughputTried.IsZero() || time.Since(l.throughputTried) >= cfg.ThroughputInterval {
+		l.throughputTried = time.Now()
+		mbps, err := measureThroughput(ctx, l.iface, m.family, cfg.ThroughputURL)
+		if err != nil {
+			m.log.Warn("error measuring throughput", "event", "throughput", "interface", l.iface.Name, "url", cfg.ThroughputURL, "error", err)
+		} else {
+			m.log.Info("measured throughput", "event", "throughput", "interface", l.iface.Name, "mbps", fmt.Sprintf("%.2f", mbps), "min_mbps", cfg.MinThroughput)
+			metricThroughput.WithLabelValues(l.iface.Name).Set(mbps)
+			m.mu.Lock()
+			l.throughput = mbps
+			l.hasThroughput = true
+			m.mu.Unlock()
+		}
+	}
+
+	if l.hasThroughput && l.throughput < cfg.MinThroughput {
+		return fmt.Errorf("throughput of %.2f Mbps is below the minimum of %v Mbps", l.throughput, cfg.MinThroughput)
+	}
+	return nil
+}
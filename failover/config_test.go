@@ -0,0 +1,197 @@
+package failover
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a configuration file with the given contents, and
+// returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gateway-failover.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+primary:
+  name: eth0
+  gateway: 192.0.2.1
+backups:
+  - name: wwan0
+    gateway: 198.51.100.1
+fail_threshold: 5
+check:
+  method: tcp
+  tcp_addr: 192.0.2.53:53
+  interval: 10s
+`)
+	cfg, err := LoadConfig([]string{"--config", path, "--primary-gw", "192.0.2.254", "--check-interval", "2s"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	// The file's values are used, and flags override them, or fill in
+	// what it leaves out; the rest are the defaults.
+	if cfg.Primary.Name != "eth0" || cfg.Primary.Gateway != "192.0.2.254" {
+		t.Errorf("primary = %+v; want eth0 via 192.0.2.254", cfg.Primary)
+	}
+	if len(cfg.Backups) != 1 || cfg.Backups[0].Name != "wwan0" || cfg.Backups[0].Gateway != "198.51.100.1" {
+		t.Errorf("backups = %+v; want wwan0 via 198.51.100.1", cfg.Backups)
+	}
+	if cfg.FailThreshold != 5 {
+		t.Errorf("fail threshold = %d; want 5 from the file", cfg.FailThreshold)
+	}
+	if cfg.Check.Method != "tcp" || cfg.Check.TCPAddr != "192.0.2.53:53" {
+		t.Errorf("check method = %s to %s; want tcp to 192.0.2.53:53 from the file", cfg.Check.Method, cfg.Check.TCPAddr)
+	}
+	if cfg.Check.Interval != 2*time.Second {
+		t.Errorf("check interval = %v; want 2s from the flag", cfg.Check.Interval)
+	}
+	if want := DefaultConfig().RecoverThreshold; cfg.RecoverThreshold != want {
+		t.Errorf("recover threshold = %d; want the default %d", cfg.RecoverThreshold, want)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"unknown field", "primary:\n  name: eth0\nbackups:\n  - name: wwan0\nfail_treshold: 5\n", "field fail_treshold not found"},
+		{"no primary", "backups:\n  - name: wwan0\n", "no primary interface"},
+		{"invalid", "primary: [eth0\n", "parsing config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.contents)
+			_, err := LoadConfig([]string{"--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v; want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("LoadConfig with a missing config file succeeded")
+	}
+}
+
+func TestLoadConfigRouteTable(t *testing.T) {
+	path := writeConfigFile(t, "primary:\n  name: eth0\nbackups:\n  - name: wwan0\ntable: 200\n")
+	for _, flag := range []string{"--table", "--route-table"} {
+		cfg, err := LoadConfig([]string{"--config", path, flag, "100"})
+		if err != nil {
+			t.Fatalf("LoadConfig with %s: %v", flag, err)
+		}
+		if cfg.Table != 100 {
+			t.Errorf("table with %s = %d; want 100", flag, cfg.Table)
+		}
+	}
+}
+
+func TestLoadConfigRouteTableEnv(t *testing.T) {
+	path := writeConfigFile(t, "primary:\n  name: eth0\nbackups:\n  - name: wwan0\ntable: 200\n")
+	for _, env := range []string{"GWFO_TABLE", "GWFO_ROUTE_TABLE"} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, "100")
+			cfg, err := LoadConfig([]string{"--config", path})
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.Table != 100 {
+				t.Errorf("table = %d; want 100 from %s", cfg.Table, env)
+			}
+
+			// Either flag on the command line takes precedence
+			// over either variable.
+			for _, flag := range []string{"--table", "--route-table"} {
+				cfg, err := LoadConfig([]string{"--config", path, flag, "300"})
+				if err != nil {
+					t.Fatalf("LoadConfig with %s: %v", flag, err)
+				}
+				if cfg.Table != 300 {
+					t.Errorf("table with %s = %d; want 300", flag, cfg.Table)
+				}
+			}
+		})
+	}
+
+	t.Setenv("GWFO_TABLE", "100")
+	t.Setenv("GWFO_ROUTE_TABLE", "300")
+	_, err := LoadConfig([]string{"--config", path})
+	if err == nil || !strings.Contains(err.Error(), "GWFO_ROUTE_TABLE") {
+		t.Errorf("LoadConfig with both variables set: error = %v; want one naming GWFO_ROUTE_TABLE", err)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeConfigFile(t, `
+primary:
+  name: eth0
+  gateway: 192.0.2.1
+backups:
+  - name: wwan0
+fail_threshold: 5
+check:
+  interval: 10s
+`)
+	t.Setenv("GWFO_FAIL_THRESHOLD", "6")
+	t.Setenv("GWFO_RECOVER_THRESHOLD", "4")
+	t.Setenv("GWFO_CHECK_INTERVAL", "3s")
+	t.Setenv("GWFO_BACKUP", "wwan0,lte0")
+	// Repeated flags take one value per line.
+	t.Setenv("GWFO_BACKUP_GW", "198.51.100.1\n203.0.113.1\n")
+	cfg, err := LoadConfig([]string{"--config", path, "--check-interval", "2s"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	// The environment overrides the file, and the command line overrides
+	// the environment.
+	if cfg.FailThreshold != 6 {
+		t.Errorf("fail threshold = %d; want 6 from the environment", cfg.FailThreshold)
+	}
+	if cfg.RecoverThreshold != 4 {
+		t.Errorf("recover threshold = %d; want 4 from the environment", cfg.RecoverThreshold)
+	}
+	if cfg.Check.Interval != 2*time.Second {
+		t.Errorf("check interval = %v; want 2s from the flag", cfg.Check.Interval)
+	}
+	want := []InterfaceConfig{{Name: "wwan0", Gateway: "198.51.100.1"}, {Name: "lte0", Gateway: "203.0.113.1"}}
+	if len(cfg.Backups) != len(want) {
+		t.Fatalf("backups = %+v; want %+v", cfg.Backups, want)
+	}
+	for i, b := range cfg.Backups {
+		if b.Name != want[i].Name || b.Gateway != want[i].Gateway {
+			t.Errorf("backup %d = %s via %s; want %s via %s", i, b.Name, b.Gateway, want[i].Name, want[i].Gateway)
+		}
+	}
+}
+
+func TestLoadConfigEnvInvalid(t *testing.T) {
+	t.Setenv("GWFO_FAIL_THRESHOLD", "lots")
+	_, err := LoadConfig([]string{"--primary", "eth0", "--backup", "wwan0"})
+	if err == nil || !strings.Contains(err.Error(), "GWFO_FAIL_THRESHOLD") {
+		t.Errorf("LoadConfig error = %v; want one naming GWFO_FAIL_THRESHOLD", err)
+	}
+}
+
+func TestLoadConfigFileBackupGateway(t *testing.T) {
+	path := writeConfigFile(t, "primary:\n  name: eth0\nbackups:\n  - name: wwan0\n")
+	cfg, err := LoadConfig([]string{"--config", path, "--backup-gw", "198.51.100.1"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Backups) != 1 || cfg.Backups[0].Gateway != "198.51.100.1" {
+		t.Errorf("backups = %+v; want wwan0 via 198.51.100.1", cfg.Backups)
+	}
+}
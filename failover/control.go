@@ -0,0 +1,208 @@
+package failover
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlTimeout bounds how long a control socket client may take to send
+// each command.
+const controlTimeout = 5 * time.Minute
+
+// A controlRequest asks a monitor's run loop to pin the default route to
+// target, or with an empty target, to return to automatic failover; see
+// pinTarget. The result is sent on reply.
+type controlRequest struct {
+	target string
+	reply  chan error
+}
+
+// errNotInGroup is returned for a control request to pin the default route to
+// an interface that isn't in the monitor's failover group.
+var errNotInGroup = errors.New("interface not in failover group")
+
+// listenControl listens on a Unix socket at path for serveControl, replacing
+// any stale socket left behind by a previous run. Only root can connect.
+func listenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveControl accepts control connections on ln until ctx is done. Each
+// connection sends newline-terminated commands, and gets a line with "ok",
+// "error: " and a message, or the JSON status in reply:
+//
+//	pin primary|backup|INTERFACE [GROUP]
+//	auto [GROUP]
+//	simulate INTERFACE up|down|file [GROUP]
+//	status
+//	history
+//
+// "pin" moves the default route to the given interface, the first backup
+// interface being "backup", and keeps it there regardless of checks until
+// "auto" returns to automatic failover. Without a group, they apply to every
+// failover group, or for an interface, to its group. With dual stack, GROUP
+// may also be qualified by the address family, e.g. "wan/ipv6" or just
+// "ipv6", to apply to only that family's default route.
+//
+// With --simulate, "simulate" sets the result of every check via an
+// interface from then on, or with "file", returns it to its sequence from
+// the simulate file. "history" replies with the JSON history; see historyOf.
+func serveControl(ctx context.Context, ln net.Listener, monitors []*monitor) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("error accepting control connection", "event", "error", "error", err)
+			}
+			return
+		}
+		go handleControl(ctx, conn, monitors)
+	}
+}
+
+func handleControl(ctx context.Context, conn net.Conn, monitors []*monitor) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controlTimeout))
+		if !sc.Scan() {
+			return
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		args := strings.Fields(line)
+		reply, err := runControlCommand(ctx, args, monitors)
+		switch {
+		case err != nil:
+			slog.Warn("control command failed", "event", "control", "command", line, "error", err)
+			reply = "error: " + err.Error()
+		case args[0] == "status", args[0] == "history":
+			// Polling the status isn't worth logging routinely.
+			slog.Debug("control command", "event", "control", "command", line)
+		default:
+			slog.Info("control command", "event", "control", "command", line)
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// runControlCommand runs a control command, split into fields, and returns
+// the reply.
+func runControlCommand(ctx context.Context, args []string, monitors []*monitor) (string, error) {
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		st, _ := statusOf(monitors)
+		b, err := json.Marshal(st)
+		return string(b), err
+	case args[0] == "history" && len(args) == 1:
+		b, err := json.Marshal(historyOf(monitors))
+		return string(b), err
+	case args[0] == "pin" && (len(args) == 2 || len(args) == 3):
+		return "ok", controlPin(ctx, monitors, args[1], args[2:])
+	case args[0] == "auto" && len(args) <= 2:
+		return "ok", controlPin(ctx, monitors, "", args[1:])
+	case args[0] == "simulate" && (len(args) == 3 || len(args) == 4):
+		return "ok", controlSimulate(monitors, args[1], args[2], args[3:])
+	}
+	return "", fmt.Errorf("unknown command %q; expected pin primary|backup|INTERFACE [GROUP], auto [GROUP], simulate INTERFACE up|down|file [GROUP], status, or history", strings.Join(args, " "))
+}
+
+// controlPin pins the default route of each of monitors in the named group,
+// or all of them if group is empty, to target: "primary", "backup", or an
+// interface name. With an empty target, it unpins them.
+func controlPin(ctx context.Context, monitors []*monitor, target string, group []string) error {
+	var matched bool
+	for _, m := range monitors {
+		if len(group) > 0 && m.name != group[0] && m.group != group[0] {
+			continue
+		}
+
+		req := controlRequest{target: target, reply: make(chan error, 1)}
+		select {
+		case m.control <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := <-req.reply
+		if errors.Is(err, errNotInGroup) {
+			continue
+		}
+		matched = true
+		if err != nil {
+			if m.name != "" {
+				return fmt.Errorf("group %s: %w", m.name, err)
+			}
+			return err
+		}
+	}
+
+	switch {
+	case matched:
+		return nil
+	case len(group) > 0 && (target == "" || target == "primary" || target == "backup"):
+		return fmt.Errorf("no failover group %q", group[0])
+	}
+	return fmt.Errorf("no interface %q", target)
+}
+
+// controlSimulate sets the simulated result of checks via the named interface
+// for each of monitors in the named group, or all of them if group is empty;
+// see simulator.setResult.
+func controlSimulate(monitors []*monitor, name, result string, group []string) error {
+	switch result {
+	case "up", "down", "file":
+	default:
+		return fmt.Errorf("unknown simulated result %q; expected up, down or file", result)
+	}
+
+	var matched bool
+	for _, m := range monitors {
+		if len(group) > 0 && m.name != group[0] && m.group != group[0] {
+			continue
+		}
+		m.mu.Lock()
+		i := m.linkIndex(name)
+		m.mu.Unlock()
+		if i < 0 {
+			continue
+		} else if m.sim == nil {
+			return errors.New("not in simulate mode")
+		}
+		matched = true
+		if err := m.sim.setResult(name, result); err != nil {
+			return err
+		}
+	}
+	if !matched {
+		return fmt.Errorf("no interface %q", name)
+	}
+	return nil
+}
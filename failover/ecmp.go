@@ -0,0 +1,213 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// checkECMP is doCheckOnce for --mode=ecmp. It checks every link, and keeps a
+// single multipath default route with a nexthop via each link that's up,
+// weighted by its interface's weight. A link goes down after FailThreshold
+// consecutive failed checks, and comes back up after RecoverThreshold
+// consecutive successful ones, and PrimaryStableFor. If every link is down,
+// the route is via all of them, since there's nothing better to do.
+func (m *monitor) checkECMP(ctx context.Context) error {
+	m.checkLinks(ctx, m.links)
+
+	var removed, added []*link
+	for _, l := range m.links {
+		switch {
+		case l.inRoute && l.failures >= m.cfg.FailThreshold:
+			l.inRoute = false
+			removed = append(removed, l)
+		case !l.inRoute && l.successes >= m.cfg.RecoverThreshold && time.Since(l.healthySince) >= m.cfg.PrimaryStableFor:
+			l.inRoute = true
+			added = append(added, l)
+		}
+	}
+	var want []*link
+	for _, l := range m.links {
+		if l.inRoute {
+			want = append(want, l)
+		}
+	}
+	if len(want) == 0 {
+		m.log.Warn("all interfaces down; keeping the default route via all of them", "event", "all_down")
+		want = m.links
+	}
+	m.interval = m.cfg.Check.Interval
+
+	have, err := getDefaultNexthops(m.dsts[0], m.cfg.Table)
+	if err != nil {
+		return err
+	}
+	if sameNexthops(have, want) {
+		m.log.Debug("default route is via every healthy interface; doing nothing", "event", "check_state", "nexthops", strings.Join(linkNames(want), ","))
+		m.setNexthops(want)
+		return nil
+	}
+
+	m.log.Info("changing multipath default route", "event", "ecmp", "from", nexthopNames(have), "to", strings.Join(linkNames(want), ","))
+	for _, dst := range m.dsts {
+		if err := setMultipathDefaultRoute(m.cfg.DryRun, m.cfg.Table, m.cfg.RouteProto, dst, want); err != nil {
+			return err
+		}
+	}
+	m.setNexthops(want)
+
+	for _, l := range removed {
+		reason := fmt.Sprintf("%d consecutive failed checks via %s: %v", l.failures, l.iface.Name, l.lastCheckErr)
+		m.ecmpSwitched("failover", l, firstOther(want, l), reason)
+	}
+	for _, l := range added {
+		reason := fmt.Sprintf("%d consecutive successful checks via %s", l.successes, l.iface.Name)
+		m.ecmpSwitched("failback", firstOther(want, l), l, reason)
+	}
+	return nil
+}
+
+// ecmpSwitched logs, counts and runs the hooks for a link being removed from
+// the multipath default route, with a "failover" event from it to the first
+// remaining link, or added to it, with a "failback" event to it.
+func (m *monitor) ecmpSwitched(event string, from, to *link, reason string) {
+	changed := to
+	if event == "failover" {
+		changed = from
+	}
+	m.log.Info("interface changed state in multipath default route", "event", event, "interface", changed.iface.Name, "gateway", changed.gw, "reason", reason)
+	if !m.cfg.DryRun {
+		m.onSwitch(event, from.iface, from.gw, to.iface, to.gw, reason)
+	}
+	metricFailovers.WithLabelValues(to.iface.Name).Inc()
+	m.recordTransition(event, from.iface.Name, to.iface.Name, reason)
+	m.mu.Lock()
+	m.lastTransition = time.Now()
+	m.mu.Unlock()
+}
+
+// setNexthops records that the default route is via links, the first of
+// which is reported as the active one.
+func (m *monitor) setNexthops(links []*link) {
+	m.setActive(links[0].iface.Name, links[0].gw)
+	m.mu.Lock()
+	m.nexthops = linkNames(links)
+	m.mu.Unlock()
+}
+
+// firstOther returns the first of links other than l, or l if there's none.
+func firstOther(links []*link, l *link) *link {
+	for _, o := range links {
+		if o != l {
+			return o
+		}
+	}
+	return l
+}
+
+// A nexthop is one of the interfaces and gateways a default route is via.
+type nexthop struct {
+	linkIndex int
+	gw        netip.Addr
+	weight    int
+}
+
+// getDefaultNexthops returns the nexthops of the route to dst, normally the
+// default route, with the lowest metric in the given routing table, or the
+// main table if it's zero, whether it's a multipath route or not. It returns
+// none if there's no such route.
+func getDefaultNexthops(dst *net.IPNet, table int) ([]nexthop, error) {
+	best, err := preferredDefaultRoute(dst, table)
+	if err != nil {
+		return nil, err
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	if len(best.MultiPath) == 0 {
+		gw, _ := netip.AddrFromSlice(best.Gw)
+		return []nexthop{{linkIndex: best.LinkIndex, gw: gw.Unmap(), weight: 1}}, nil
+	}
+	var nhs []nexthop
+	for _, nh := range best.MultiPath {
+		gw, _ := netip.AddrFromSlice(nh.Gw)
+		nhs = append(nhs, nexthop{linkIndex: nh.LinkIndex, gw: gw.Unmap(), weight: nh.Hops + 1})
+	}
+	return nhs, nil
+}
+
+// sameNexthops reports whether have are the nexthops for links, in any order.
+func sameNexthops(have []nexthop, links []*link) bool {
+	if len(have) != len(links) {
+		return false
+	}
+	for _, l := range links {
+		found := false
+		for _, nh := range have {
+			if nh.linkIndex == l.iface.Index && nh.gw == l.gw && (nh.weight == l.weight || len(links) == 1) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// linkNames returns the interface names of links.
+func linkNames(links []*link) []string {
+	names := make([]string, len(links))
+	for i, l := range links {
+		names[i] = l.iface.Name
+	}
+	return names
+}
+
+// nexthopNames returns the interface names of nhs, as a comma-separated list
+// for logging.
+func nexthopNames(nhs []nexthop) string {
+	var names []string
+	for _, nh := range nhs {
+		if iface, err := interfaceByIndex(nh.linkIndex); err == nil {
+			names = append(names, iface.Name)
+		} else {
+			names = append(names, fmt.Sprintf("if%d", nh.linkIndex))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// setMultipathDefaultRoute replaces the default route, or the route to dst,
+// in the given routing table (or the main table, if zero) with one via each
+// of links, weighted by their weights, and marked with the given route
+// protocol, if it's non-zero. With a single link, it's an ordinary route.
+func setMultipathDefaultRoute(dryRun bool, table, proto int, dst *net.IPNet, links []*link) error {
+	if len(links) == 1 {
+		return setDefaultRoute(dryRun, table, proto, dst, links[0].iface, links[0].gw)
+	}
+
+	r := &netlink.Route{
+		Dst:      dst,
+		Table:    table,
+		Protocol: proto,
+	}
+	for _, l := range links {
+		r.MultiPath = append(r.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: l.iface.Index,
+			Gw:        l.gw.AsSlice(),
+			Hops:      l.weight - 1,
+		})
+	}
+	if err := routeReplace(r, dryRun); err != nil {
+		return fmt.Errorf("setting multipath default route via %s: %w", strings.Join(linkNames(links), ", "), err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package failover
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// multipathRoute returns a multipath default route via the primary and
+// backup test links, with weights 1 and 2.
+func multipathRoute() netlink.Route {
+	return netlink.Route{Dst: defaultDst4, MultiPath: []*netlink.NexthopInfo{
+		{LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()},
+		{LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice(), Hops: 1},
+	}}
+}
+
+func TestCheckECMP(t *testing.T) {
+	primaryRoute := netlink.Route{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}
+	backupRoute := netlink.Route{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice()}
+	viaBoth := "ip route replace default nexthop via 10.0.0.1 dev wan0 weight 1 nexthop via 10.0.1.1 dev wwan0 weight 2"
+
+	tests := []struct {
+		name string
+		// route is the default route before the check, inRoute whether
+		// each link is in it, and failures and successes each link's
+		// consecutive check results. down are the interfaces checks
+		// fail via.
+		route               netlink.Route
+		inRoute             [2]bool
+		failures, successes [2]int
+		down                []string
+		// want are the route changes made, and wantNexthops the
+		// interfaces the default route is via afterwards.
+		want         []string
+		wantNexthops []string
+	}{
+		{
+			name:         "all up",
+			route:        multipathRoute(),
+			inRoute:      [2]bool{true, true},
+			wantNexthops: []string{"wan0", "wwan0"},
+		},
+		{
+			name:         "failing",
+			route:        multipathRoute(),
+			inRoute:      [2]bool{true, true},
+			failures:     [2]int{1, 0},
+			down:         []string{"wan0"},
+			wantNexthops: []string{"wan0", "wwan0"},
+		},
+		{
+			name:         "down",
+			route:        multipathRoute(),
+			inRoute:      [2]bool{true, true},
+			failures:     [2]int{2, 0},
+			down:         []string{"wan0"},
+			want:         []string{"ip route replace default via 10.0.1.1 dev wwan0"},
+			wantNexthops: []string{"wwan0"},
+		},
+		{
+			name:         "recovered",
+			route:        backupRoute,
+			inRoute:      [2]bool{false, true},
+			successes:    [2]int{1, 0},
+			want:         []string{viaBoth},
+			wantNexthops: []string{"wan0", "wwan0"},
+		},
+		{
+			// With every link down, the route stays via all of them.
+			name:         "all down",
+			route:        multipathRoute(),
+			inRoute:      [2]bool{true, true},
+			failures:     [2]int{2, 2},
+			down:         []string{"wan0", "wwan0"},
+			wantNexthops: []string{"wan0", "wwan0"},
+		},
+		{
+			name:         "last one down",
+			route:        primaryRoute,
+			inRoute:      [2]bool{true, false},
+			failures:     [2]int{2, 5},
+			down:         []string{"wan0", "wwan0"},
+			want:         []string{viaBoth},
+			wantNexthops: []string{"wan0", "wwan0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeNetlink(t, tt.route)
+
+			cfg := DefaultConfig()
+			cfg.Mode = "ecmp"
+			down := make(map[string]bool)
+			for _, name := range tt.down {
+				down[name] = true
+			}
+			m := newTestMonitor(cfg, fakeChecker{down: down})
+			for i, l := range m.links {
+				l.weight = i + 1
+				l.inRoute = tt.inRoute[i]
+				l.failures, l.successes = tt.failures[i], tt.successes[i]
+			}
+
+			if err := m.doCheckOnce(context.Background()); err != nil {
+				t.Fatalf("doCheckOnce: %v", err)
+			}
+			var changes []string
+			for _, call := range f.takeCalls() {
+				if call != "ip route get 8.8.8.8" {
+					changes = append(changes, call)
+				}
+			}
+			if !slices.Equal(changes, tt.want) {
+				t.Errorf("route changes = %q; want %q", changes, tt.want)
+			}
+			if !slices.Equal(m.nexthops, tt.wantNexthops) {
+				t.Errorf("nexthops = %q; want %q", m.nexthops, tt.wantNexthops)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package failover
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables that flags may also be
+// set with, for containers: --check-interval is GWFO_CHECK_INTERVAL, and so on.
+const envPrefix = "GWFO_"
+
+// envName returns the name of the environment variable for the named flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// flagAliases maps flags that are other names for the same setting to the
+// flag they're an alias of.
+var flagAliases = map[string]string{
+	"route-table": "table",
+}
+
+// setFromEnv sets each flag in fs that isn't in set, those given on the
+// command line, which take precedence, from its environment variable, if
+// that's set, and adds it to set. Flags that may be repeated but not
+// comma-separated take one value per line. A flag and its alias count as one:
+// either given on the command line takes precedence over both variables, and
+// it's an error to set both variables. It returns the names of the variables
+// used.
+func setFromEnv(fs *flag.FlagSet, set map[string]bool) ([]string, error) {
+	for alias, name := range flagAliases {
+		if set[alias] || set[name] {
+			set[alias], set[name] = true, true
+			continue
+		}
+		_, ok := os.LookupEnv(envName(alias))
+		if _, ok2 := os.LookupEnv(envName(name)); ok && ok2 {
+			return nil, fmt.Errorf("%s and %s are the same setting; set only one", envName(name), envName(alias))
+		}
+	}
+
+	var (
+		used []string
+		err  error
+	)
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		vals := []string{val}
+		if l, ok := f.Value.(*listFlag); ok && l.noSplit {
+			vals = strings.Split(strings.TrimRight(val, "\n"), "\n")
+		}
+		for _, v := range vals {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, name, serr)
+				return
+			}
+		}
+		set[f.Name] = true
+		used = append(used, name)
+	})
+	return used, err
+}
+
+// listFlag is a flag.Value holding a list of strings, which may be given
+// either by repeating the flag or as a comma-separated list. Values given on
+// the command line replace the default rather than appending to it.
+type listFlag struct {
+	p       *[]string
+	set     bool
+	noSplit bool // if set, values aren't split on commas
+}
+
+// listVar defines a list flag with the given name and usage string on fs,
+// storing its values in p. The current contents of p are the default.
+func listVar(fs *flag.FlagSet, p *[]string, name string, usage string) {
+	fs.Var(&listFlag{p: p}, name, usage)
+}
+
+// repeatedVar defines a list flag on fs whose values are only given by
+// repeating the flag, for values that may contain commas.
+func repeatedVar(fs *flag.FlagSet, p *[]string, name string, usage string) {
+	fs.Var(&listFlag{p: p, noSplit: true}, name, usage)
+}
+
+func (l *listFlag) String() string {
+	if l == nil || l.p == nil {
+		return ""
+	}
+	return strings.Join(*l.p, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	if !l.set {
+		*l.p = nil
+		l.set = true
+	}
+	if l.noSplit {
+		*l.p = append(*l.p, s)
+		return nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l.p = append(*l.p, v)
+		}
+	}
+	return nil
+}
+
+// uint32Flag is a flag.Value holding a uint32, which may be given in decimal,
+// or in hex or octal with a 0x or 0 prefix.
+type uint32Flag struct {
+	p *uint32
+}
+
+// uint32Var defines a uint32 flag with the given name and usage string on
+// fs, storing its value in p. The current contents of p are the default.
+func uint32Var(fs *flag.FlagSet, p *uint32, name string, usage string) {
+	fs.Var(&uint32Flag{p: p}, name, usage)
+}
+
+func (f *uint32Flag) String() string {
+	if f == nil || f.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*f.p), 10)
+}
+
+func (f *uint32Flag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return err
+	}
+	*f.p = uint32(v)
+	return nil
+}
@@ -0,0 +1,681 @@
+package failover
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// errGatewayNotReady is returned by gateway autodetection when the interface
+// exists but hasn't been assigned a gateway yet, e.g. because it's still
+// coming up. Detection may succeed if retried later.
+var errGatewayNotReady = errors.New("gateway not configured yet")
+
+// parseOrGetGateways parses val as a comma-separated list of iface's gateways
+// in priority order. If it's empty, or a single invalid address, the gateway
+// is autodetected with the given method instead.
+func parseOrGetGateways(val string, iface *net.Interface, family int, method string) ([]netip.Addr, error) {
+	if !strings.Contains(val, ",") {
+		gw, err := parseOrGetGateway(val, iface, family, method)
+		if err != nil {
+			return nil, err
+		}
+		return []netip.Addr{gw}, nil
+	}
+
+	var gws []netip.Addr
+	for _, s := range strings.Split(val, ",") {
+		gw, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %q: %w", s, err)
+		} else if !familyMatches(gw, family) {
+			return nil, fmt.Errorf("gateway %v is not an IPv%d address", gw, ipVersion(family))
+		}
+		if gw, err = unzonedGateway(gw, iface); err != nil {
+			return nil, err
+		}
+		gws = append(gws, gw)
+	}
+	return gws, nil
+}
+
+func parseOrGetGateway(val string, iface *net.Interface, family int, method string) (netip.Addr, error) {
+	if val != "" {
+		gw, err := netip.ParseAddr(val)
+		if err == nil {
+			if !familyMatches(gw, family) {
+				return netip.Addr{}, fmt.Errorf("gateway %v is not an IPv%d address", gw, ipVersion(family))
+			}
+			return unzonedGateway(gw, iface)
+		}
+	}
+
+	gw, err := getGateway(iface, family, method)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	slog.Info("autodetected gateway", "event", "gateway_detected", "interface", iface.Name, "gateway", gw)
+	return gw, nil
+}
+
+// getGateway autodetects iface's gateway using the given method; see
+// Config.GatewayMethod. If the method fails for any reason other than the
+// gateway not being configured yet, the default route in /proc is tried as a
+// last resort. Like configured gateways, detected ones are returned without
+// an IPv6 zone; see unzonedGateway.
+func getGateway(iface *net.Interface, family int, method string) (netip.Addr, error) {
+	gw, err := getGatewayMethod(iface, family, method)
+	if err == nil || method == "proc" || errors.Is(err, errGatewayNotReady) {
+		return gw.WithZone(""), err
+	}
+
+	gw, perr := getGatewayProc(iface, family)
+	if perr != nil {
+		return netip.Addr{}, err
+	}
+	slog.Warn("gateway autodetection failed; using default route from /proc", "event", "gateway_detected", "interface", iface.Name, "method", method, "gateway", gw, "error", err)
+	return gw.WithZone(""), nil
+}
+
+func getGatewayMethod(iface *net.Interface, family int, method string) (netip.Addr, error) {
+	switch method {
+	case "proc":
+		return getGatewayProc(iface, family)
+	case "networkmanager":
+		return getGatewayNetworkManager(iface, family)
+	case "openwrt":
+		return getGatewayOpenWrt(iface, family)
+	case "", "route":
+		return getGatewayFromRoute(iface, family)
+	case "ra":
+		if family == netlink.FAMILY_V6 {
+			return getGatewayFromRA(iface)
+		}
+		// There are no router advertisements for IPv4, so with dual
+		// stack, its gateways are read from the routes as usual.
+		return getGatewayFromRoute(iface, family)
+	case "systemd-networkd":
+		if family == netlink.FAMILY_V6 {
+			return getGatewaySystemdNetworkd6(iface)
+		}
+		return getGatewaySystemdNetworkd(iface)
+	}
+
+	if family == netlink.FAMILY_V6 {
+		return netip.Addr{}, errors.New("IPv6 gateway autodetection is not supported by this backend")
+	}
+
+	switch method {
+	case "dhcpcd":
+		return getGatewayDhcpcd(iface)
+	case "dhclient":
+		return getGatewayDhclient(iface)
+	default:
+		return netip.Addr{}, fmt.Errorf("unknown gateway method %q", method)
+	}
+}
+
+// unzonedGateway returns gw, a configured gateway via iface, without its IPv6
+// zone, if it has one, e.g. "fe80::1%eth0" for a link-local gateway learned
+// from router advertisements. The zone is implied by the interface, which
+// routes via gw are installed with, and addresses read back from the kernel
+// don't have one, so gateways are kept without it and the zone is added back
+// where needed, e.g. when pinging them. A zone that names a different
+// interface, by name or index, is an error, as is one on a gateway that isn't
+// link-local.
+func unzonedGateway(gw netip.Addr, iface *net.Interface) (netip.Addr, error) {
+	gw = gw.Unmap()
+	zone := gw.Zone()
+	if zone == "" {
+		return gw, nil
+	}
+	if !gw.IsLinkLocalUnicast() {
+		return netip.Addr{}, fmt.Errorf("gateway %v has a zone, but isn't link-local", gw)
+	}
+	if zone != iface.Name && zone != strconv.Itoa(iface.Index) {
+		return netip.Addr{}, fmt.Errorf("gateway %v is via %s, but its zone is %q", gw, iface.Name, zone)
+	}
+	return gw.WithZone(""), nil
+}
+
+// checkGatewayOnLink returns an error unless gw can be reached directly on
+// iface: it's link-local, within the subnet of one of iface's addresses, or
+// covered by a link-scoped route via iface, as with an "onlink" gateway
+// outside the interface's subnet.
+func checkGatewayOnLink(iface *net.Interface, gw netip.Addr) error {
+	if gw.IsLinkLocalUnicast() {
+		return nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("getting addresses for %s: %w", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(gw.AsSlice()) {
+			return nil
+		}
+	}
+
+	family := netlink.FAMILY_V4
+	if gw.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := nl.RouteListFiltered(family, &netlink.Route{
+		LinkIndex: iface.Index,
+	}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return fmt.Errorf("listing routes via %s: %w", iface.Name, err)
+	}
+	for _, route := range routes {
+		if route.Scope == netlink.SCOPE_LINK && route.Dst != nil && route.Dst.Contains(gw.AsSlice()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %v is not on any subnet of %s", gw, iface.Name)
+}
+
+// getGatewayFromRoute returns the gateway of the default route via iface in
+// the kernel's main routing table. If there's more than one, the one with
+// the lowest metric is used.
+func getGatewayFromRoute(iface *net.Interface, family int) (netip.Addr, error) {
+	routes, err := nl.RouteListFiltered(family, &netlink.Route{
+		LinkIndex: iface.Index,
+	}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("listing routes for %s: %w", iface.Name, err)
+	}
+
+	var (
+		gw     netip.Addr
+		metric int
+	)
+	for _, route := range routes {
+		if !isDefaultRoute(route) || route.Gw == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(route.Gw)
+		if !ok {
+			continue
+		}
+		if !gw.IsValid() || route.Priority < metric {
+			gw, metric = addr.Unmap(), route.Priority
+		}
+	}
+	if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no default route via %s: %w", iface.Name, errGatewayNotReady)
+	}
+	return gw, nil
+}
+
+// getGatewayFromRA returns the gateway of the IPv6 default route via iface in
+// the kernel's main routing table that was learned from router
+// advertisements, for interfaces configured by SLAAC, without DHCPv6 lease
+// files to read it from. It's normally the router's link-local address. RA
+// routes from several routers may be merged into a multipath route, in which
+// case the nexthop via iface is used. If there's no RA route, e.g. with a
+// static default route on the interface, any default route via it is used
+// instead; otherwise, the one with the lowest metric is.
+func getGatewayFromRA(iface *net.Interface) (netip.Addr, error) {
+	routes, err := tableRoutes(netlink.FAMILY_V6, 0)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("listing routes for %s: %w", iface.Name, err)
+	}
+
+	var (
+		gw     netip.Addr
+		fromRA bool
+		metric int
+	)
+	consider := func(route netlink.Route, linkIndex int, addr net.IP) {
+		a, ok := netip.AddrFromSlice(addr)
+		if linkIndex != iface.Index || !ok {
+			return
+		}
+		ra := route.Protocol == unix.RTPROT_RA
+		if !gw.IsValid() || ra && !fromRA || ra == fromRA && route.Priority < metric {
+			gw, fromRA, metric = a, ra, route.Priority
+		}
+	}
+	for _, route := range routes {
+		if !isDefaultRoute(route) {
+			continue
+		}
+		if route.Gw != nil {
+			consider(route, route.LinkIndex, route.Gw)
+		}
+		for _, nh := range route.MultiPath {
+			if nh.Gw != nil {
+				consider(route, nh.LinkIndex, nh.Gw)
+			}
+		}
+	}
+	if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no IPv6 default route via %s from router advertisements: %w", iface.Name, errGatewayNotReady)
+	}
+	return gw, nil
+}
+
+// getGatewayProc returns the gateway of the default route via iface, read
+// from /proc/net/route or /proc/net/ipv6_route, so that it works without
+// netlink or any external commands. If there's more than one, the one with
+// the lowest metric is used.
+func getGatewayProc(iface *net.Interface, family int) (netip.Addr, error) {
+	path, parse := "/proc/net/route", parseProcRoute
+	if family == netlink.FAMILY_V6 {
+		path, parse = "/proc/net/ipv6_route", parseProcIPv6Route
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+
+	var (
+		gw     netip.Addr
+		metric uint64
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, addr, m, ok := parse(strings.Fields(scanner.Text()))
+		if !ok || name != iface.Name {
+			continue
+		}
+		if !gw.IsValid() || m < metric {
+			gw, metric = addr, m
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return netip.Addr{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no default route via %s in %s: %w", iface.Name, path, errGatewayNotReady)
+	}
+	return gw, nil
+}
+
+// rtfGateway is the RTF_GATEWAY route flag, set on routes via a gateway.
+const rtfGateway = 0x2
+
+// parseProcRoute parses a line of /proc/net/route, e.g.
+//
+//	eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+//
+// and returns the interface, gateway and metric if it's a default route
+// via a gateway. Addresses are in hex, in host byte order.
+func parseProcRoute(fields []string) (iface string, gw netip.Addr, metric uint64, ok bool) {
+	if len(fields) < 8 {
+		return "", netip.Addr{}, 0, false
+	}
+	dst, err1 := strconv.ParseUint(fields[1], 16, 32)
+	gwHex, err2 := strconv.ParseUint(fields[2], 16, 32)
+	flags, err3 := strconv.ParseUint(fields[3], 16, 16)
+	metric, err4 := strconv.ParseUint(fields[6], 10, 32)
+	mask, err5 := strconv.ParseUint(fields[7], 16, 32)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+		return "", netip.Addr{}, 0, false // e.g. the header
+	}
+	if dst != 0 || mask != 0 || flags&rtfGateway == 0 {
+		return "", netip.Addr{}, 0, false
+	}
+
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(gwHex))
+	return fields[0], netip.AddrFrom4(b), metric, true
+}
+
+// parseProcIPv6Route parses a line of /proc/net/ipv6_route, e.g.
+//
+//	00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00450003 eth0
+//
+// and returns the interface, gateway and metric if it's a default route
+// via a gateway. Addresses and numbers are in hex, in network byte order.
+func parseProcIPv6Route(fields []string) (iface string, gw netip.Addr, metric uint64, ok bool) {
+	if len(fields) < 10 {
+		return "", netip.Addr{}, 0, false
+	}
+	if strings.Trim(fields[0], "0") != "" || fields[1] != "00" {
+		return "", netip.Addr{}, 0, false
+	}
+	flags, err := strconv.ParseUint(fields[8], 16, 32)
+	if err != nil || flags&rtfGateway == 0 {
+		return "", netip.Addr{}, 0, false
+	}
+	metric, err = strconv.ParseUint(fields[5], 16, 32)
+	if err != nil {
+		return "", netip.Addr{}, 0, false
+	}
+	b, err := hex.DecodeString(fields[4])
+	if err != nil || len(b) != 16 {
+		return "", netip.Addr{}, 0, false
+	}
+	return fields[9], netip.AddrFrom16([16]byte(b)), metric, true
+}
+
+// isDefaultRoute reports whether route is a default route (0.0.0.0/0 or ::/0).
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0 && route.Dst.IP.IsUnspecified()
+}
+
+// getGatewaySystemdNetworkd returns the DHCPv4 router of iface from the lease
+// file systemd-networkd keeps for it, which is named by its ifindex. A VLAN
+// has its own ifindex and lease, separate from its parent's.
+func getGatewaySystemdNetworkd(iface *net.Interface) (netip.Addr, error) {
+	leaseFile := filepath.Join("/run/systemd/netif/leases", strconv.Itoa(iface.Index))
+	f, err := os.Open(leaseFile)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		if key == "ROUTER" {
+			return netip.ParseAddr(value)
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("ROUTER not found in lease file")
+}
+
+// networkdLinkStatus is the subset of the JSON status of a link from
+// "networkctl --json=short status" that we care about. Addresses are arrays
+// of bytes.
+type networkdLinkStatus struct {
+	Routes []struct {
+		Family                  int   `json:"Family"`
+		DestinationPrefixLength int   `json:"DestinationPrefixLength"`
+		Gateway                 []int `json:"Gateway"`
+		Priority                int   `json:"Priority"`
+	} `json:"Routes"`
+}
+
+// getGatewaySystemdNetworkd6 returns the IPv6 default router for iface
+// known to systemd-networkd. Unlike the DHCPv4 router, routers learned from
+// router advertisements aren't recorded in networkd's state files under
+// /run/systemd/netif, so they're read from networkctl's JSON output instead,
+// which needs systemd 250 or later. If there's more than one, the one with
+// the lowest metric is used.
+func getGatewaySystemdNetworkd6(iface *net.Interface) (netip.Addr, error) {
+	out, err := exec.Command("networkctl", "--json=short", "status", iface.Name).Output()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var st networkdLinkStatus
+	if err := json.Unmarshal(out, &st); err != nil {
+		return netip.Addr{}, fmt.Errorf("parsing networkctl status for %s: %w", iface.Name, err)
+	}
+
+	var (
+		gw     netip.Addr
+		metric int
+	)
+	for _, r := range st.Routes {
+		if r.Family != syscall.AF_INET6 || r.DestinationPrefixLength != 0 || len(r.Gateway) != 16 {
+			continue
+		}
+		var b [16]byte
+		for i, v := range r.Gateway {
+			b[i] = byte(v)
+		}
+		addr := netip.AddrFrom16(b)
+		if addr.IsUnspecified() {
+			continue
+		}
+		if !gw.IsValid() || r.Priority < metric {
+			gw, metric = addr, r.Priority
+		}
+	}
+	if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no IPv6 default route via %s known to systemd-networkd: %w", iface.Name, errGatewayNotReady)
+	}
+	return gw, nil
+}
+
+func getGatewayDhcpcd(iface *net.Interface) (netip.Addr, error) {
+	cmd := exec.Command("dhcpcd", "-U", iface.Name)
+	out, err := cmd.Output()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "routers" {
+			return netip.ParseAddr(value)
+		}
+	}
+
+	return netip.Addr{}, errors.New("routers not found in dhcpcd output")
+}
+
+// dhclientLease is the subset of an ISC dhclient lease that we care about.
+type dhclientLease struct {
+	iface  string
+	router netip.Addr
+	expire time.Time // zero if the lease never expires
+}
+
+func getGatewayDhclient(iface *net.Interface) (netip.Addr, error) {
+	leaseFile := filepath.Join("/var/lib/dhcp", "dhclient."+iface.Name+".leases")
+	f, err := os.Open(leaseFile)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+
+	// dhclient appends new leases to the end of the file, so the last
+	// matching lease is the most recent one.
+	var (
+		now     = time.Now()
+		inLease bool
+		cur     dhclientLease
+		found   bool
+		gw      netip.Addr
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "lease {":
+			inLease = true
+			cur = dhclientLease{}
+
+		case line == "}":
+			if inLease && (cur.iface == "" || cur.iface == iface.Name) && cur.router.IsValid() {
+				found = true
+				if cur.expire.IsZero() || cur.expire.After(now) {
+					gw = cur.router
+				}
+			}
+			inLease = false
+
+		case inLease:
+			key, value, _ := strings.Cut(strings.TrimSuffix(line, ";"), " ")
+			switch key {
+			case "interface":
+				cur.iface = strings.Trim(value, `"`)
+			case "option":
+				name, val, _ := strings.Cut(value, " ")
+				if name == "routers" {
+					// May be a comma-separated list; use the first.
+					first, _, _ := strings.Cut(val, ",")
+					cur.router, _ = netip.ParseAddr(strings.TrimSpace(first))
+				}
+			case "expire":
+				var ok bool
+				if cur.expire, ok = parseDhclientTime(value); !ok {
+					// Rather than trusting a lease we
+					// can't tell the expiry of, treat it
+					// as expired.
+					slog.Warn("can't parse dhclient lease expiry; ignoring the lease", "event", "error", "interface", iface.Name, "file", leaseFile, "expire", value)
+					cur.expire = time.Unix(0, 0)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return netip.Addr{}, err
+	}
+
+	if !found {
+		return netip.Addr{}, fmt.Errorf("no lease with routers for %s in %s", iface.Name, leaseFile)
+	} else if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("all leases for %s in %s have expired: %w", iface.Name, leaseFile, errGatewayNotReady)
+	}
+	return gw, nil
+}
+
+// parseDhclientTime parses a dhclient lease time, which is either
+// "<weekday> YYYY/MM/DD HH:MM:SS" in UTC, or "epoch <seconds>", followed by a
+// comment giving the local time, when dhclient is configured with
+// "db-time-format local". It returns the zero time for "never", and false if
+// s can't be parsed.
+func parseDhclientTime(s string) (time.Time, bool) {
+	s, _, _ = strings.Cut(s, ";")
+	s = strings.TrimSpace(s)
+	if s == "never" {
+		return time.Time{}, true
+	}
+
+	if rest, ok := strings.CutPrefix(s, "epoch "); ok {
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(n, 0), true
+	}
+
+	_, rest, ok := strings.Cut(s, " ") // skip the weekday
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006/01/02 15:04:05", rest)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func getGatewayNetworkManager(iface *net.Interface, family int) (netip.Addr, error) {
+	field := "IP4.GATEWAY"
+	if family == netlink.FAMILY_V6 {
+		field = "IP6.GATEWAY"
+	}
+
+	cmd := exec.Command("nmcli", "-g", field, "device", "show", iface.Name)
+	out, err := cmd.Output()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	val := strings.TrimSpace(string(out))
+	if val == "" {
+		// NetworkManager knows about the device, but it hasn't finished
+		// configuring it yet.
+		return netip.Addr{}, fmt.Errorf("%s not set by NetworkManager for %s: %w", field, iface.Name, errGatewayNotReady)
+	}
+	return netip.ParseAddr(val)
+}
+
+// openwrtInterface is the subset of the status of one of netifd's logical
+// interfaces, as dumped by "ubus call network.interface dump", that we care
+// about.
+type openwrtInterface struct {
+	Interface string `json:"interface"`
+	Up        bool   `json:"up"`
+	L3Device  string `json:"l3_device"`
+	Route     []struct {
+		Target  string `json:"target"`
+		Mask    int    `json:"mask"`
+		Nexthop string `json:"nexthop"`
+		Metric  int    `json:"metric"`
+	} `json:"route"`
+}
+
+// getGatewayOpenWrt returns the nexthop of the default route that OpenWrt's
+// netifd has for iface, which may belong to more than one of its logical
+// interfaces, e.g. "wan" and "wan6". If there's more than one, the one with
+// the lowest metric is used.
+func getGatewayOpenWrt(iface *net.Interface, family int) (netip.Addr, error) {
+	out, err := exec.Command("ubus", "call", "network.interface", "dump").Output()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("running ubus: %w", err)
+	}
+	var dump struct {
+		Interface []openwrtInterface `json:"interface"`
+	}
+	if err := json.Unmarshal(out, &dump); err != nil {
+		return netip.Addr{}, fmt.Errorf("parsing ubus output: %w", err)
+	}
+
+	var (
+		found  bool
+		gw     netip.Addr
+		metric int
+	)
+	for _, ifc := range dump.Interface {
+		if ifc.L3Device != iface.Name {
+			continue
+		}
+		found = true
+		if !ifc.Up {
+			continue
+		}
+		for _, r := range ifc.Route {
+			target, err := netip.ParseAddr(r.Target)
+			if err != nil || !target.IsUnspecified() || r.Mask != 0 || !familyMatches(target, family) {
+				continue
+			}
+			addr, err := netip.ParseAddr(r.Nexthop)
+			if err != nil || addr.IsUnspecified() {
+				continue
+			}
+			if !gw.IsValid() || r.Metric < metric {
+				gw, metric = addr.Unmap(), r.Metric
+			}
+		}
+	}
+	if !found {
+		return netip.Addr{}, fmt.Errorf("no OpenWrt network interface for %s", iface.Name)
+	} else if !gw.IsValid() {
+		return netip.Addr{}, fmt.Errorf("no IPv%d default route via %s known to netifd: %w", ipVersion(family), iface.Name, errGatewayNotReady)
+	}
+	return gw, nil
+}
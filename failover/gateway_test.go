@@ -0,0 +1,139 @@
+package failover
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDhclientTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"4 2026/10/15 06:27:31", time.Date(2026, 10, 15, 6, 27, 31, 0, time.UTC), true},
+		{"epoch 1760509651", time.Unix(1760509651, 0), true},
+		{"epoch 1760509651; # Wed Oct 15 06:27:31 2026", time.Unix(1760509651, 0), true},
+		{"never", time.Time{}, true},
+		{"epoch soon", time.Time{}, false},
+		{"4 2026-10-15 06:27:31", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDhclientTime(tt.in)
+		if !got.Equal(tt.want) || ok != tt.ok {
+			t.Errorf("parseDhclientTime(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// procRouteAddr formats addr as it appears in /proc/net/route, in host byte
+// order.
+func procRouteAddr(addr string) string {
+	return fmt.Sprintf("%08X", binary.NativeEndian.Uint32(netip.MustParseAddr(addr).AsSlice()))
+}
+
+func TestParseProcRoute(t *testing.T) {
+	gw := procRouteAddr("10.0.0.1")
+	tests := []struct {
+		name   string
+		line   string
+		iface  string
+		gw     string
+		metric uint64
+		ok     bool
+	}{
+		{
+			name:   "default route",
+			line:   "eth0\t00000000\t" + gw + "\t0003\t0\t0\t100\t00000000\t0\t0\t0",
+			iface:  "eth0",
+			gw:     "10.0.0.1",
+			metric: 100,
+			ok:     true,
+		},
+		{
+			name: "header",
+			line: "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT",
+		},
+		{
+			name: "not a default route",
+			line: "eth0\t" + procRouteAddr("192.0.2.0") + "\t" + gw + "\t0003\t0\t0\t0\t" + procRouteAddr("255.255.255.0") + "\t0\t0\t0",
+		},
+		{
+			name: "no gateway",
+			line: "eth0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0",
+		},
+		{
+			name: "short",
+			line: "eth0\t00000000\t" + gw,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface, gw, metric, ok := parseProcRoute(strings.Fields(tt.line))
+			if ok != tt.ok {
+				t.Fatalf("parseProcRoute ok = %v; want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if iface != tt.iface || gw.String() != tt.gw || metric != tt.metric {
+				t.Errorf("parseProcRoute = %s, %v, %d; want %s, %s, %d", iface, gw, metric, tt.iface, tt.gw, tt.metric)
+			}
+		})
+	}
+}
+
+func TestParseProcIPv6Route(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		iface  string
+		gw     string
+		metric uint64
+		ok     bool
+	}{
+		{
+			name:   "default route",
+			line:   "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00450003 eth0",
+			iface:  "eth0",
+			gw:     "fd00::1",
+			metric: 1024,
+			ok:     true,
+		},
+		{
+			name: "not a default route",
+			line: "20010db8000000000000000000000000 40 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000100 00000001 00000000 00450003 eth0",
+		},
+		{
+			name: "no gateway",
+			line: "00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 00000400 00000001 00000000 00000001 eth0",
+		},
+		{
+			name: "bad gateway",
+			line: "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd00 00000400 00000001 00000000 00450003 eth0",
+		},
+		{
+			name: "short",
+			line: "00000000000000000000000000000000 00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface, gw, metric, ok := parseProcIPv6Route(strings.Fields(tt.line))
+			if ok != tt.ok {
+				t.Fatalf("parseProcIPv6Route ok = %v; want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if iface != tt.iface || gw.String() != tt.gw || metric != tt.metric {
+				t.Errorf("parseProcIPv6Route = %s, %v, %d; want %s, %s, %d", iface, gw, metric, tt.iface, tt.gw, tt.metric)
+			}
+		})
+	}
+}
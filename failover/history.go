@@ -0,0 +1,105 @@
+package failover
+
+import "time"
+
+// A transition is a change of the interface carrying a monitor's default
+// route, as reported by the history.
+type transition struct {
+	Time time.Time `json:"time"`
+	// Event is "failover", "failback" or "takeover", as logged.
+	Event string `json:"event"`
+	// From is the interface the default route was via, if any, and
+	// FromSeconds how long it had been, if known; it isn't for an
+	// unmanaged interface taken over from.
+	From        string  `json:"from,omitempty"`
+	FromSeconds float64 `json:"from_seconds,omitempty"`
+	To          string  `json:"to"`
+	Reason      string  `json:"reason"`
+}
+
+// history is a monitor's recent transitions, as served on /history.
+type history struct {
+	// Transitions are the most recent transitions, oldest first, up to
+	// Config.HistorySize of them.
+	Transitions []transition `json:"transitions"`
+	// Counts are the number of transitions of each event since startup,
+	// including those no longer in Transitions.
+	Counts map[string]int `json:"counts"`
+	// ActiveSeconds is how long the default route has been via each
+	// interface since startup. With --mode=ecmp, it's the time each
+	// interface was the first of the nexthops.
+	ActiveSeconds map[string]float64 `json:"active_seconds"`
+}
+
+// recordTransition adds a transition from the named interface, or none if
+// from is empty, to another to m's history. It must be called before
+// setActive records the new interface.
+func (m *monitor) recordTransition(event, from, to, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	t := transition{Time: now, Event: event, From: from, To: to, Reason: reason}
+	if from != "" && from == m.active && !m.activeSince.IsZero() {
+		t.FromSeconds = now.Sub(m.activeSince).Seconds()
+	}
+	m.counts[event]++
+	if m.cfg.HistorySize <= 0 {
+		m.transitions = nil
+		return
+	}
+	m.transitions = append(m.transitions, t)
+	if len(m.transitions) > m.cfg.HistorySize {
+		m.transitions = m.transitions[len(m.transitions)-m.cfg.HistorySize:]
+	}
+}
+
+// accountActive adds the time the default route has been via the active
+// interface to its total, when it changes to the named one. The monitor's mu
+// must be held.
+func (m *monitor) accountActive(name string) {
+	if name == m.active {
+		return
+	}
+	now := time.Now()
+	if m.active != "" && !m.activeSince.IsZero() {
+		m.activeTime[m.active] += now.Sub(m.activeSince)
+	}
+	m.activeSince = now
+}
+
+// history returns a snapshot of m's history.
+func (m *monitor) history() history {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := history{
+		Transitions:   append([]transition{}, m.transitions...),
+		Counts:        make(map[string]int, len(m.counts)),
+		ActiveSeconds: make(map[string]float64, len(m.activeTime)+1),
+	}
+	for event, n := range m.counts {
+		h.Counts[event] = n
+	}
+	for name, d := range m.activeTime {
+		h.ActiveSeconds[name] = d.Seconds()
+	}
+	if m.active != "" && !m.activeSince.IsZero() {
+		h.ActiveSeconds[m.active] += time.Since(m.activeSince).Seconds()
+	}
+	return h
+}
+
+// historyOf returns the history of monitors for reporting: that of the only
+// monitor if there are no failover groups, or otherwise a map of each
+// group's name to its history, as with statusOf.
+func historyOf(monitors []*monitor) any {
+	groups := make(map[string]history, len(monitors))
+	for _, m := range monitors {
+		if m.name == "" {
+			return m.history()
+		}
+		groups[m.name] = m.history()
+	}
+	return groups
+}
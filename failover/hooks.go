@@ -0,0 +1,49 @@
+package failover
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runHook runs the hook command at path, if set, after the default route for
+// the given IP version has been switched from one interface to another in the
+// named failover group, killing it if it runs for longer than timeout.
+// Details of the switch, including the reason for it, are passed in the
+// environment. For an "all_down" event, from and to are both the interface the
+// default route is via.
+// Failures are logged to log but otherwise ignored.
+func runHook(log *slog.Logger, path string, timeout time.Duration, group string, family int, event string, from *net.Interface, fromGw netip.Addr, to *net.Interface, toGw netip.Addr, reason string) {
+	if path == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(),
+		"EVENT="+event,
+		"OLD_IFACE="+from.Name,
+		"OLD_GW="+fromGw.String(),
+		"NEW_IFACE="+to.Name,
+		"NEW_GW="+toGw.String(),
+		"GROUP="+group,
+		"FAMILY="+strconv.Itoa(family),
+		"REASON="+reason,
+	)
+
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Error("hook failed", "event", "hook", "hook_event", event, "path", path, "duration", time.Since(start).Round(time.Millisecond), "error", err, "output", strings.TrimSpace(string(out)))
+		return
+	}
+	log.Info("hook succeeded", "event", "hook", "hook_event", event, "path", path, "duration", time.Since(start).Round(time.Millisecond))
+}
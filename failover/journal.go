@@ -0,0 +1,181 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// journalSocket is where journald listens for its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler is a slog.Handler that writes records to the systemd journal
+// with its native protocol, so that each attribute becomes a structured field
+// named after its key in upper case, e.g. EVENT=failover or INTERFACE=eth0,
+// which journalctl can match on.
+//
+// PRIORITY is set from the record's level, except that failovers, which are
+// logged at the info level like other state changes, are raised to warning,
+// since they mean the preferred interface has gone down.
+type journalHandler struct {
+	conn     *net.UnixConn
+	level    slog.Leveler
+	fallback slog.Handler // for records the journal won't take
+
+	prefix string // for attribute keys, from WithGroup
+	fields []byte // from WithAttrs
+}
+
+// newJournalHandler returns a journalHandler logging records at level and
+// above, or an error if the journal isn't available. Records that can't be
+// sent to it are written to fallback instead.
+func newJournalHandler(level slog.Leveler, fallback slog.Handler) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level, fallback: fallback}, nil
+}
+
+func (h *journalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "gateway-failover")
+	b.Write(h.fields)
+
+	priority := journalPriority(r.Level)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "event" && a.Value.String() == "failover" && priority > priorityWarning {
+			priority = priorityWarning
+		}
+		h.appendAttr(&b, h.prefix, a)
+		return true
+	})
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(priority))
+
+	if _, err := h.conn.Write(b.Bytes()); err != nil {
+		// Most likely the record is too big for a datagram, or
+		// journald has gone away.
+		return h.fallback.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var b bytes.Buffer
+	b.Write(h.fields)
+	for _, a := range attrs {
+		h2.appendAttr(&b, h.prefix, a)
+	}
+	h2.fields = b.Bytes()
+	h2.fallback = h.fallback.WithAttrs(attrs)
+	return &h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "_"
+	h2.fallback = h.fallback.WithGroup(name)
+	return &h2
+}
+
+// appendAttr writes a as a journal field to b, with its key prefixed by
+// prefix. Groups are flattened, with their names joined by underscores.
+func (h *journalHandler) appendAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	switch {
+	case a.Equal(slog.Attr{}):
+		return
+	case v.Kind() == slog.KindGroup:
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range v.Group() {
+			h.appendAttr(b, prefix, ga)
+		}
+		return
+	}
+
+	var s string
+	switch v.Kind() {
+	case slog.KindDuration:
+		s = v.Duration().String()
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339Nano)
+	default:
+		s = v.String()
+	}
+	writeJournalField(b, journalFieldName(prefix+a.Key), s)
+}
+
+// journalFieldName returns key as a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore, which is
+// reserved for fields set by journald itself.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "F" + name
+	}
+	return name
+}
+
+// writeJournalField writes a field to b in the journal's native protocol:
+// "NAME=value\n", or for values containing newlines, the name and a newline
+// followed by the value's length as a little-endian uint64, the value, and a
+// newline.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// Syslog priorities used in the journal's PRIORITY field.
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+	priorityDebug   = 7
+)
+
+// journalPriority returns the journal priority for a slog level.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return priorityErr
+	case level >= slog.LevelWarn:
+		return priorityWarning
+	case level >= slog.LevelInfo:
+		return priorityInfo
+	}
+	return priorityDebug
+}
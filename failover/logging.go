@@ -0,0 +1,239 @@
+package failover
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// levelTrace is the log level for the result of every individual check
+// target, enabled with -vv.
+const levelTrace = slog.LevelDebug - 4
+
+// loggingSetUp is whether SetupLogging has been called, so that the logging
+// is only set up again on reload if it's ours rather than an embedding
+// program's.
+var loggingSetUp bool
+
+// SetupLogging sets the default slog logger to write in the given format:
+// "text" or "json" on stderr, or "journal" for the systemd journal, falling
+// back to text if it isn't available. The level is set by verbosity: at 0,
+// only state changes and errors are logged; at 1, routine per-check progress
+// is also logged; and at 2, the result of every individual check target. If
+// dedupInterval is non-zero, repeated warnings and errors are suppressed; see
+// dedupHandler.
+func SetupLogging(format string, verbosity int, dedupInterval time.Duration) {
+	loggingSetUp = true
+	level := slog.LevelInfo
+	switch {
+	case verbosity >= 2:
+		level = levelTrace
+	case verbosity == 1:
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "timestamp"
+			case slog.LevelKey:
+				if a.Value.Any().(slog.Level) == levelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	var journalErr error
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "journal":
+		text := slog.NewTextHandler(os.Stderr, opts)
+		if h, journalErr = newJournalHandler(level, text); journalErr != nil {
+			h = text
+		}
+	default:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	if dedupInterval > 0 {
+		h = newDedupHandler(h, dedupInterval)
+	}
+	slog.SetDefault(slog.New(h))
+
+	if journalErr != nil {
+		slog.Warn("systemd journal not available; logging to stderr", "event", "startup", "error", journalErr)
+	}
+}
+
+// dedupHandler is a slog.Handler that suppresses repeats of a warning or
+// error, with the same message and attributes, for interval after it's
+// logged, so that a sustained outage doesn't flood the logs with the same
+// check failure every interval. The next time it's logged, it has a
+// "repeated" attribute with the number of repeats suppressed in between.
+// When anything is logged at the info level, which is done for state
+// changes, the number of repeats of everything suppressed so far is logged
+// instead, so that the logs are complete up to that point.
+type dedupHandler struct {
+	slog.Handler
+	state *dedupState
+	key   string // from WithAttrs and WithGroup
+}
+
+type dedupState struct {
+	mu       sync.Mutex
+	interval time.Duration
+	seen     map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	r       slog.Record // as last logged
+	h       slog.Handler
+	repeats int // since r was logged
+}
+
+func newDedupHandler(h slog.Handler, interval time.Duration) *dedupHandler {
+	return &dedupHandler{
+		Handler: h,
+		state: &dedupState{
+			interval: interval,
+			seen:     make(map[string]*dedupEntry),
+		},
+	}
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		if r.Level >= slog.LevelInfo {
+			h.flush(ctx)
+		}
+		return h.Handler.Handle(ctx, r)
+	}
+
+	var b strings.Builder
+	b.WriteString(h.key)
+	b.WriteString(r.Level.String() + " " + r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(" " + a.String())
+		return true
+	})
+	key := b.String()
+
+	s := h.state
+	s.mu.Lock()
+	e := s.seen[key]
+	if e != nil && r.Time.Sub(e.r.Time) < s.interval {
+		e.repeats++
+		s.mu.Unlock()
+		return nil
+	}
+	repeats := 0
+	if e != nil {
+		repeats = e.repeats
+	}
+	for k, e := range s.seen {
+		if e.repeats == 0 && r.Time.Sub(e.r.Time) >= s.interval {
+			delete(s.seen, k)
+		}
+	}
+	s.seen[key] = &dedupEntry{r: r.Clone(), h: h.Handler}
+	s.mu.Unlock()
+
+	if repeats > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("repeated", repeats))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// flush logs the number of repeats of every suppressed record, and forgets
+// them.
+func (h *dedupHandler) flush(ctx context.Context) {
+	s := h.state
+	s.mu.Lock()
+	var pending []*dedupEntry
+	for k, e := range s.seen {
+		if e.repeats > 0 {
+			pending = append(pending, e)
+		}
+		delete(s.seen, k)
+	}
+	s.mu.Unlock()
+
+	for _, e := range pending {
+		r := slog.NewRecord(time.Now(), e.r.Level, "last message repeated", 0)
+		r.AddAttrs(
+			slog.String("event", "log_repeated"),
+			slog.String("message", e.r.Message),
+			slog.Int("repeated", e.repeats),
+		)
+		e.r.Attrs(func(a slog.Attr) bool {
+			if a.Key != "event" {
+				r.AddAttrs(a)
+			}
+			return true
+		})
+		e.h.Handle(ctx, r)
+	}
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.key)
+	for _, a := range attrs {
+		b.WriteString(a.String() + " ")
+	}
+	return &dedupHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state, key: b.String()}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithGroup(name), state: h.state, key: h.key + name + "."}
+}
+
+// verbosityFlag is a boolean-style flag.Value that raises a verbosity level
+// by step each time it's given, so that e.g. "-v -v" is the same as "-vv".
+// It can also be set to an explicit level, as in "-v=2".
+type verbosityFlag struct {
+	p    *int
+	step int
+}
+
+func (f *verbosityFlag) IsBoolFlag() bool { return true }
+
+func (f *verbosityFlag) String() string {
+	if f.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*f.p)
+}
+
+func (f *verbosityFlag) Set(s string) error {
+	if b, err := strconv.ParseBool(s); err == nil {
+		if b {
+			*f.p += f.step
+		} else {
+			*f.p = 0
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*f.p = n
+	return nil
+}
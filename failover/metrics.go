@@ -0,0 +1,83 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_failover_checks_total",
+		Help: "Total number of upstream health checks performed.",
+	}, []string{"interface"})
+	metricCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_failover_check_failures_total",
+		Help: "Total number of upstream health checks that failed.",
+	}, []string{"interface"})
+	metricCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_failover_check_duration_seconds",
+		Help:    "Round-trip time of upstream health checks.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+	}, []string{"interface"})
+	metricFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_failover_route_switches_total",
+		Help: "Total number of times the default route was switched, by the interface switched to.",
+	}, []string{"to"})
+	metricActiveInterface = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_failover_active_interface",
+		Help: "Priority of the interface currently carrying the default route; 0 for primary, 1 for the first backup, and so on, or -1 for an unmanaged interface. The group label is the failover group, if any.",
+	}, []string{"group"})
+	metricThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_failover_throughput_mbps",
+		Help: "Latest download throughput measured via the interface, in megabits per second.",
+	}, []string{"interface"})
+	metricInboundReachable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_failover_inbound_reachable",
+		Help: "Whether the --external-check-url service last reported it could connect back to us via the interface; 1 if so, 0 if not.",
+	}, []string{"interface"})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(
+		metricChecks,
+		metricCheckFailures,
+		metricCheckDuration,
+		metricFailovers,
+		metricActiveInterface,
+		metricThroughput,
+		metricInboundReachable,
+	)
+}
+
+// serveMetrics serves Prometheus metrics on /metrics from ln until ctx is
+// done.
+func serveMetrics(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	serveHTTP(ctx, ln, mux)
+}
+
+// serveHTTP serves HTTP requests from ln with handler until ctx is done,
+// then shuts the server down.
+func serveHTTP(ctx context.Context, ln net.Listener, handler http.Handler) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("error serving HTTP", "event", "error", "addr", ln.Addr(), "error", err)
+	}
+}
@@ -0,0 +1,944 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A monitor periodically checks the upstream via its interfaces, and moves
+// the default route between them as they go down and come back up. The
+// interfaces are in priority order: the primary, then each backup.
+type monitor struct {
+	cfg *Config
+	// name identifies the monitor, as Config.id, and group is its
+	// failover group's name, if it has one. Unlike cfg, they don't change
+	// on reload, so they can be read from any goroutine.
+	name    string
+	group   string
+	family  int // netlink.FAMILY_V4 or netlink.FAMILY_V6
+	checker Checker
+	// sim supplies the check results instead of checker with
+	// --simulate, and is nil otherwise. It doesn't change on reload.
+	sim *simulator
+	// log is the logger for the monitor's failover group, which adds the
+	// group's name to each message, if it has one.
+	log *slog.Logger
+
+	// routeDst is the destination used to look up which interface is
+	// carrying the default route; see checkDestination.
+	routeDst netip.Addr
+	// dsts are the destinations of the routes we manage: the default
+	// route's, unless RouteDst is set. The first is looked up to see which
+	// interface they're via.
+	dsts []*net.IPNet
+
+	// links are the interfaces to route via, in priority order; links[0]
+	// is the primary interface.
+	links []*link
+
+	// hooks tracks running hooks and notifications, so that they can be
+	// waited for before exiting.
+	hooks sync.WaitGroup
+	// mqtt publishes the state with --mqtt-broker, and is nil otherwise.
+	// It's shared by every monitor.
+	mqtt *mqttPublisher
+
+	// initial is the name of the interface that was carrying the default
+	// route when we started, if known.
+	initial string
+	// graceUntil is the end of the startup grace period, during which
+	// routes aren't changed, until it's over.
+	graceUntil time.Time
+	// startupFailback is set, with StartupFailback, until the first check
+	// that may change routes, so that it can fail back right away.
+	startupFailback bool
+
+	// control receives requests from the control socket, reload new
+	// configurations on SIGHUP, and checkNow requests to check right away
+	// on SIGUSR1, which are handled by the run loop.
+	control  chan controlRequest
+	reload   chan reloadRequest
+	checkNow chan struct{}
+
+	// mu protects the fields below, links, and the check results in each
+	// link, which are written by the goroutine running doCheckOnce and read
+	// when reporting status. It also protects writes to each link's gw.
+	mu sync.Mutex
+	// active is the name of the interface carrying the default route, and
+	// activeGw its gateway, if known.
+	active   string
+	activeGw netip.Addr
+	// nexthops are the names of the interfaces the multipath default
+	// route is via, with --mode=ecmp; active is the first of them.
+	nexthops []string
+	// lastTransition is when we last switched the default route.
+	lastTransition time.Time
+	// transitions are the most recent transitions, oldest first, and
+	// counts the number of each event since startup; see history.
+	transitions []transition
+	counts      map[string]int
+	// activeSince is when the default route last changed to active, and
+	// activeTime the total time it's been via each other interface
+	// before that.
+	activeSince time.Time
+	activeTime  map[string]time.Duration
+	// pinned is the index of the link the default route has been pinned
+	// to via the control socket, or -1 if it's switched automatically.
+	pinned int
+	// notMaster is set while routes aren't being changed because, with
+	// PassiveUnlessMaster, this node isn't the VRRP master.
+	notMaster bool
+
+	// nextCheck is when the next check is due to start, so that a
+	// monitor stuck in a check can be detected, and checked is set once
+	// the first check has completed.
+	nextCheck time.Time
+	checked   bool
+
+	// allDownSince is when every link started failing its checks, if
+	// they all are, and allDownFired is set once the recovery action has
+	// been run for it; see checkAllDown.
+	allDownSince time.Time
+	allDownFired bool
+
+	// routesStale is set when an interface has been recreated with a new
+	// index, so that the routes for the policy routing rules via it need
+	// reinstalling.
+	routesStale bool
+
+	// interval is the time until the next check. It's normally
+	// cfg.Check.Interval, but backs off exponentially up to
+	// cfg.Check.MaxInterval while we're on a backup interface and every
+	// higher-priority interface is still down.
+	interval time.Duration
+}
+
+// A link is one of the interfaces a monitor can route via, and its gateway.
+// An interface with multiple gateways has a link for each of them.
+type link struct {
+	// name is the interface's name or MAC address, as configured, and
+	// iface is the interface it currently refers to.
+	name  string
+	iface *net.Interface
+	gw    netip.Addr
+
+	// detectGw is set if gw was autodetected rather than given
+	// explicitly, so that it should be refreshed in case it changes.
+	detectGw bool
+
+	// noCarrier is set while the interface has no carrier, is down, or
+	// has been removed, according to netlink updates. Checks fail with
+	// errNoCarrier without being done.
+	noCarrier bool
+	// standby is set while the interface has been set down by
+	// --manage-backup-link since it isn't needed. Checks fail with
+	// errStandby without being done. wokenAt is when it was last
+	// brought up again.
+	standby bool
+	wokenAt time.Time
+
+	// weight is the link's weight in the multipath default route with
+	// --mode=ecmp, and inRoute is set while it's up, so that it's one of
+	// the route's nexthops.
+	weight  int
+	inRoute bool
+
+	// fwmark is the firewall mark to set on check sockets, if non-zero.
+	fwmark uint32
+	// checker, if set, does the checks via this link instead of the
+	// monitor's checker, for an interface with its own check settings.
+	checker Checker
+	// checkTable, if non-zero, is the routing table holding a default
+	// route via gw, which checks via this link are routed with by setting
+	// fwmark to it. It's used when the interface has multiple gateways,
+	// so that each gateway is checked individually.
+	checkTable int
+
+	// failures and successes count the consecutive failed and successful
+	// checks via this link; at most one of them is non-zero.
+	failures  int
+	successes int
+	// healthySince is the start of the first of the current run of
+	// successful checks, if successes is non-zero.
+	healthySince time.Time
+	lastCheck    time.Time
+	lastCheckErr error
+	// rtts are the round-trip times of the most recent successful checks,
+	// oldest first, if the checker measures them.
+	rtts []time.Duration
+	// results are whether each of the most recent checks passed, oldest
+	// first, and scoreRTTs the round-trip times of the successful ones
+	// that measured one, for the link's --best-link score.
+	results   []bool
+	scoreRTTs []time.Duration
+
+	// throughput is the latest download throughput measured via the link,
+	// in Mbps, if hasThroughput is set, and throughputTried is when it was
+	// last measured or tried to be.
+	throughput      float64
+	hasThroughput   bool
+	throughputTried time.Time
+
+	// inbound is whether the external check service last reported it
+	// could reach us via the link, if hasInbound is set, publicIP the
+	// address it saw us at, and externalTried when it was last asked.
+	inbound       bool
+	hasInbound    bool
+	publicIP      string
+	externalTried time.Time
+}
+
+// run checks the upstream every m.interval, and refreshes autodetected
+// gateways if configured to, until ctx is done. It also checks right away
+// when an interface loses or regains carrier.
+func (m *monitor) run(ctx context.Context) {
+	timer := time.NewTimer(m.setNextCheck())
+	defer timer.Stop()
+
+	linkCh := m.subscribeLinks(ctx)
+
+	var refresh, metricRefresh optionalTicker
+	refresh.Reset(m.cfg.GatewayRefreshInterval)
+	defer refresh.Stop()
+	metricRefresh.Reset(m.primaryMetricInterval())
+	defer metricRefresh.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if linkCh == nil {
+				linkCh = m.subscribeLinks(ctx)
+			}
+			m.check(ctx)
+			timer.Reset(m.setNextCheck())
+		case u, ok := <-linkCh:
+			if !ok {
+				// The subscription failed; retry at the next
+				// check.
+				linkCh = nil
+				continue
+			}
+			if !m.handleLinkUpdate(u) {
+				continue
+			}
+			stopTimer(timer)
+			m.check(ctx)
+			timer.Reset(m.setNextCheck())
+		case <-refresh.C():
+			m.refreshGateways()
+		case <-metricRefresh.C():
+			m.orderByMetric()
+		case req := <-m.control:
+			req.reply <- m.pinTarget(req.target)
+		case <-m.checkNow:
+			stopTimer(timer)
+			m.check(ctx)
+			timer.Reset(m.setNextCheck())
+		case req := <-m.reload:
+			err := m.applyConfig(req.cfg)
+			req.reply <- err
+			if err != nil {
+				continue
+			}
+			refresh.Reset(m.cfg.GatewayRefreshInterval)
+			metricRefresh.Reset(m.primaryMetricInterval())
+			// Start again with the new interval, and check the new
+			// interfaces right away.
+			stopTimer(timer)
+			m.check(ctx)
+			timer.Reset(m.setNextCheck())
+		}
+	}
+}
+
+// stopTimer stops t, draining its channel if it had already fired, so that
+// it can be reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// An optionalTicker is a time.Ticker that's disabled by a zero interval.
+type optionalTicker struct {
+	t *time.Ticker
+}
+
+// C returns the ticker's channel, which is nil while it's disabled.
+func (t *optionalTicker) C() <-chan time.Time {
+	if t.t == nil {
+		return nil
+	}
+	return t.t.C
+}
+
+// Reset starts the ticker again with interval d, or disables it if d is zero.
+func (t *optionalTicker) Reset(d time.Duration) {
+	t.Stop()
+	if d > 0 {
+		t.t = time.NewTicker(d)
+	}
+}
+
+func (t *optionalTicker) Stop() {
+	if t.t != nil {
+		t.t.Stop()
+		t.t = nil
+	}
+}
+
+// check does a single check, logging any error, and saves the resulting
+// state.
+func (m *monitor) check(ctx context.Context) {
+	m.log.Debug("checking for internet status", "event", "check_start")
+	if err := m.doCheckOnce(ctx); err != nil {
+		m.log.Error("error checking", "event", "error", "error", err)
+	}
+	m.persist()
+	m.mu.Lock()
+	m.checked = true
+	m.mu.Unlock()
+}
+
+// setNextCheck records that the next check is due after m.interval,
+// randomized by up to the check jitter either way so that probes from many
+// monitors don't synchronize, and returns how long that is.
+func (m *monitor) setNextCheck() time.Duration {
+	d := m.interval
+	if j := m.cfg.Check.Jitter; j > 0 {
+		d += time.Duration(rand.Int63n(2*int64(j)+1)) - j
+	}
+	m.mu.Lock()
+	m.nextCheck = time.Now().Add(d)
+	m.mu.Unlock()
+	return d
+}
+
+// overdue reports whether m's next check is more than grace overdue, which
+// means it's stuck.
+func (m *monitor) overdue(grace time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.nextCheck.IsZero() && time.Since(m.nextCheck) > grace
+}
+
+// ready reports whether m has completed its first check.
+func (m *monitor) ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checked
+}
+
+func (m *monitor) doCheckOnce(ctx context.Context) error {
+	if m.routesStale {
+		if err := m.installRules(); err != nil {
+			m.log.Warn("error reinstalling policy routing rules for recreated interface; retrying at the next check", "event", "error", "error", err)
+		} else {
+			m.routesStale = false
+		}
+	}
+	// Links without carrier fail their checks right away, rather than
+	// after the check timeout.
+	m.refreshCarrier()
+
+	currentGateway, currentGw, err := m.currentRoute()
+	if err != nil {
+		return err
+	}
+
+	m.setActive(currentGateway, currentGw)
+	active := m.linkIndexVia(currentGateway, currentGw)
+
+	m.mu.Lock()
+	pinned := m.pinned
+	m.mu.Unlock()
+	if pinned >= 0 {
+		// Keep checking, so that the status stays up to date for when
+		// we're unpinned.
+		m.checkLinks(ctx, m.links)
+		m.log.Debug("default route is pinned; not switching", "event", "check_state", "interface", m.links[pinned].iface.Name, "active", currentGateway)
+		m.interval = m.cfg.Check.Interval
+		return nil
+	}
+
+	if m.passive() {
+		m.checkLinks(ctx, m.links)
+		m.log.Debug("not VRRP master; not changing routes", "event", "check_state", "active", currentGateway)
+		m.interval = m.cfg.Check.Interval
+		return nil
+	}
+
+	if !m.graceUntil.IsZero() {
+		if grace := time.Until(m.graceUntil); grace > 0 {
+			m.checkLinks(ctx, m.links)
+			m.log.Debug("in startup grace period; not changing routes", "event", "check_state", "remaining", grace.Round(time.Millisecond), "active", currentGateway)
+			m.interval = m.cfg.Check.Interval
+			return nil
+		}
+		m.log.Info("startup grace period over", "event", "startup")
+		m.graceUntil = time.Time{}
+	}
+
+	startup := m.startupFailback
+	m.startupFailback = false
+
+	if m.cfg.Mode == "ecmp" {
+		return m.checkECMP(ctx)
+	}
+	if active < 0 {
+		return m.takeOver(ctx, currentGateway)
+	}
+
+	// Check every interface at once: the active one, to see whether it's
+	// failed; higher-priority ones, to see whether we can switch back to
+	// them; and lower-priority ones, to know which are viable to fail over
+	// to if we need to.
+	m.checkLinks(ctx, m.links)
+	if m.cfg.BestLink {
+		return m.checkBest(active)
+	}
+
+	// If a higher-priority interface has recovered, switch back to the
+	// first such one. At startup, with StartupFailback, one successful
+	// check is enough, since we didn't see it go down.
+	recovering := false
+	for i, l := range m.links[:active] {
+		if l.successes == 0 {
+			continue
+		}
+		recovering = true
+		if startup {
+			return m.switchTo(active, i, fmt.Sprintf("%s passed its first check at startup", l.iface.Name))
+		}
+		if l.successes < m.cfg.RecoverThreshold {
+			m.log.Debug("check succeeded; staying on current interface", "event", "check_state", "interface", l.iface.Name, "successes", l.successes, "threshold", m.cfg.RecoverThreshold, "active", currentGateway)
+			continue
+		}
+		if stable := time.Since(l.healthySince); stable < m.cfg.PrimaryStableFor {
+			m.log.Debug("check succeeded; waiting for interface to be stable", "event", "check_state", "interface", l.iface.Name, "stable", stable.Round(time.Millisecond), "stable_for", m.cfg.PrimaryStableFor, "active", currentGateway)
+			continue
+		}
+
+		reason := fmt.Sprintf("%d consecutive successful checks via %s", l.successes, l.iface.Name)
+		return m.switchTo(active, i, reason)
+	}
+	if recovering || active == 0 {
+		m.interval = m.cfg.Check.Interval
+	}
+
+	cur := m.links[active]
+	if cur.lastCheckErr == nil {
+		if m.cfg.ManageBackupLink {
+			m.standbyBackups(active)
+		}
+		if active == 0 {
+			m.log.Debug("on primary interface; doing nothing", "event", "check_state", "interface", cur.iface.Name)
+		} else {
+			m.log.Debug("on backup interface; doing nothing", "event", "check_state", "interface", cur.iface.Name)
+			if !recovering {
+				m.backOff()
+			}
+		}
+		return nil
+	}
+
+	if cur.failures < m.cfg.FailThreshold {
+		m.log.Debug("check failed; staying on current interface", "event", "check_state", "interface", cur.iface.Name, "failures", cur.failures, "threshold", m.cfg.FailThreshold)
+		return nil
+	}
+
+	next := m.pickBackup(active)
+	if next < 0 && m.cfg.ManageBackupLink && m.wakeBackup(active) {
+		m.interval = m.cfg.Check.Interval
+		return nil
+	}
+	if next < 0 {
+		// Switching to a backup that's also down would leave us no
+		// better off, and possibly worse if the active interface is
+		// only flaky.
+		if active == 0 {
+			m.log.Warn("all interfaces down; staying on primary", "event", "all_down", "interface", cur.iface.Name)
+		} else {
+			m.log.Warn("interface down, but no lower-priority interface is healthy; staying on it", "event", "all_down", "interface", cur.iface.Name)
+			if !recovering {
+				m.backOff()
+			}
+		}
+		return nil
+	}
+
+	reason := fmt.Sprintf("%d consecutive failed checks via %s: %v", cur.failures, cur.iface.Name, cur.lastCheckErr)
+	if errors.Is(cur.lastCheckErr, errNoCarrier) {
+		reason = fmt.Sprintf("%s has no carrier", cur.iface.Name)
+	}
+	return m.switchTo(active, next, reason)
+}
+
+// takeOver is used when the default route is via current, an interface that
+// isn't one of ours, e.g. a VPN or a bridge, or there's no default route in
+// the group's routing table yet, in which case current is empty. It checks
+// every link, and installs the default route via the highest-priority
+// healthy one, or the primary if none is healthy. No hooks are run, since
+// there's no previous link to report.
+func (m *monitor) takeOver(ctx context.Context, current string) error {
+	m.checkLinks(ctx, m.links)
+	to := 0
+	for i, l := range m.links {
+		if l.lastCheckErr == nil {
+			to = i
+			break
+		}
+	}
+
+	l := m.links[to]
+	if l.detectGw {
+		m.refreshGateway(l)
+	}
+	if current == "" {
+		m.log.Info("no default route; installing one", "event", "takeover", "to", l.iface.Name, "gateway", l.gw, "table", m.cfg.Table, "healthy", l.lastCheckErr == nil)
+	} else {
+		m.log.Warn("default route is via unmanaged interface; taking it over", "event", "takeover", "from", current, "to", l.iface.Name, "gateway", l.gw, "healthy", l.lastCheckErr == nil)
+	}
+	if err := m.installRoute(to); err != nil {
+		return err
+	}
+	reason := "no default route"
+	if current != "" {
+		reason = "default route via unmanaged interface " + current
+	}
+	m.recordTransition("takeover", current, l.iface.Name, reason)
+	m.interval = m.cfg.Check.Interval
+	return nil
+}
+
+// installRoute installs the default route via the link at index to,
+// replacing whichever one there is, without running any hooks.
+func (m *monitor) installRoute(to int) error {
+	l := m.links[to]
+	var err error
+	if m.cfg.Mode == "metric" {
+		err = m.setRouteMetrics(to)
+	} else {
+		for _, dst := range m.dsts {
+			if err = setDefaultRoute(m.cfg.DryRun, m.cfg.Table, m.cfg.RouteProto, dst, l.iface, l.gw); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.setActive(l.iface.Name, l.gw)
+	return nil
+}
+
+// pinTarget pins the default route to target, which is "primary", "backup"
+// for the first backup interface, or an interface name, or with an empty
+// target, returns to automatic failover; see setPin. It returns
+// errNotInGroup if target is an interface that isn't one of m's.
+func (m *monitor) pinTarget(target string) error {
+	pin := -1
+	switch target {
+	case "":
+	case "primary":
+		pin = 0
+	case "backup":
+		pin = m.linkIndex(m.cfg.Backups[0].Name)
+	default:
+		if pin = m.linkIndex(target); pin < 0 {
+			return errNotInGroup
+		}
+	}
+	return m.setPin(pin)
+}
+
+// setPin pins the default route to the link at index pin, switching to it if
+// it isn't already there, so that it stays there regardless of checks. A
+// negative pin returns to automatic failover.
+func (m *monitor) setPin(pin int) error {
+	if pin < 0 {
+		m.mu.Lock()
+		m.pinned = -1
+		m.mu.Unlock()
+		m.log.Info("returning to automatic failover", "event", "unpin")
+		return nil
+	}
+
+	currentGateway, currentGw, err := getDefaultRouteInterface(m.routeDst, m.dsts[0], m.cfg.Table)
+	if err != nil {
+		return err
+	}
+	m.setActive(currentGateway, currentGw)
+	active := m.linkIndexVia(currentGateway, currentGw)
+
+	l := m.links[pin]
+	if woken, err := m.wakeLink(l); err != nil {
+		return err
+	} else if woken {
+		return fmt.Errorf("%s was set down while it wasn't needed; bringing it up, try again once it passes checks", l.iface.Name)
+	}
+	m.log.Info("pinning default route", "event", "pin", "interface", l.iface.Name, "gateway", l.gw)
+	switch {
+	case active == pin:
+	case active < 0:
+		err = m.installRoute(pin)
+	default:
+		err = m.switchTo(active, pin, "pinned via control socket")
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.pinned = pin
+	m.mu.Unlock()
+	m.interval = m.cfg.Check.Interval
+	return nil
+}
+
+// checkLinks concurrently checks the upstream via each of links, and records
+// the results.
+func (m *monitor) checkLinks(ctx context.Context, links []*link) {
+	var wg sync.WaitGroup
+	for _, l := range links {
+		wg.Add(1)
+		go func(l *link) {
+			defer wg.Done()
+			m.checkLink(ctx, l)
+		}(l)
+	}
+	wg.Wait()
+	m.checkAllDown()
+}
+
+// checkLink checks the upstream via l, records the result, and returns any
+// error from the check.
+func (m *monitor) checkLink(ctx context.Context, l *link) error {
+	start := time.Now()
+	if l.standby {
+		m.recordCheck(l, start, errStandby)
+		return errStandby
+	}
+	ctx = withGateway(withFwmark(ctx, l.fwmark), l.gw)
+	var rtt time.Duration
+	var err error
+	switch {
+	case m.sim != nil:
+		err = m.sim.check(l)
+	case l.noCarrier:
+		err = errNoCarrier
+	default:
+		checker := m.checker
+		if l.checker != nil {
+			checker = l.checker
+		}
+		rtt, err = checkRTT(ctx, checker, l.iface)
+	}
+	metricChecks.WithLabelValues(l.iface.Name).Inc()
+	metricCheckDuration.WithLabelValues(l.iface.Name).Observe(time.Since(start).Seconds())
+	if err == nil && rtt > 0 {
+		err = m.checkLatency(l, rtt)
+	}
+	if err == nil && m.sim == nil {
+		err = m.checkThroughput(ctx, l)
+	}
+	if err == nil && m.sim == nil {
+		err = m.checkExternal(ctx, l)
+	}
+	if err != nil {
+		m.log.Warn("check failed", "event", "check", "interface", l.iface.Name, "gateway", l.gw, "error", err)
+		metricCheckFailures.WithLabelValues(l.iface.Name).Inc()
+	} else {
+		m.log.Debug("check succeeded", "event", "check", "interface", l.iface.Name, "gateway", l.gw, "duration", time.Since(start), "rtt", rtt)
+	}
+	m.recordCheck(l, start, err)
+	if m.cfg.BestLink {
+		m.recordScore(l, rtt, err)
+	}
+	return err
+}
+
+// checkLatency records rtt as the latest round-trip time via l, and returns
+// an error if the configured maximum latency is exceeded by the mean of the
+// most recent samples.
+func (m *monitor) checkLatency(l *link, rtt time.Duration) error {
+	max, samples := m.cfg.Check.MaxLatency, m.cfg.Check.LatencySamples
+	if max <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	l.rtts = append(l.rtts, rtt)
+	if len(l.rtts) > samples {
+		l.rtts = l.rtts[len(l.rtts)-samples:]
+	}
+	rtts := l.rtts
+	m.mu.Unlock()
+
+	if len(rtts) < samples {
+		return nil
+	}
+	var total time.Duration
+	for _, d := range rtts {
+		total += d
+	}
+	if mean := total / time.Duration(len(rtts)); mean > max {
+		return fmt.Errorf("mean latency %v over the last %d checks exceeds maximum of %v", mean, len(rtts), max)
+	}
+	return nil
+}
+
+// pickBackup returns the index of the first link after the active one whose
+// latest check succeeded, or -1 if there's none.
+func (m *monitor) pickBackup(active int) int {
+	for i := active + 1; i < len(m.links); i++ {
+		if m.links[i].lastCheckErr == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// switchTo moves the default route from the link at index from to the link
+// at index to, and runs any hooks. Moving to a lower-priority link is a
+// failover, and to a higher-priority one a failback. With VerifyGateway, the
+// route is left as it is if the new link's gateway is unreachable.
+func (m *monitor) switchTo(from, to int, reason string) error {
+	old, l := m.links[from], m.links[to]
+	event := "failover"
+	if to < from {
+		event = "failback"
+	}
+
+	if l.detectGw {
+		m.refreshGateway(l)
+	}
+	if err := m.verifyGateway(l); err != nil {
+		m.log.Warn("gateway of interface to switch to is unreachable; not switching", "event", "verify_gateway", "from", old.iface.Name, "to", l.iface.Name, "gateway", l.gw, "reason", reason, "error", err)
+		return nil
+	}
+	m.log.Info("switching default route", "event", event, "from", old.iface.Name, "from_gateway", old.gw, "to", l.iface.Name, "gateway", l.gw, "reason", reason)
+	if err := m.switchRoute(from, to); err != nil {
+		return err
+	}
+	if !m.cfg.DryRun {
+		m.onSwitch(event, old.iface, old.gw, l.iface, l.gw, reason)
+	}
+	metricFailovers.WithLabelValues(l.iface.Name).Inc()
+	m.recordTransition(event, old.iface.Name, l.iface.Name, reason)
+	m.setActive(l.iface.Name, l.gw)
+	m.mu.Lock()
+	m.lastTransition = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// restore switches the default route back to the primary interface, if it
+// was there when we started and has since moved to a backup.
+func (m *monitor) restore() error {
+	primary := m.links[0]
+	if m.initial != primary.iface.Name {
+		m.log.Info("default route wasn't via the primary interface at startup; not restoring", "event", "restore", "interface", m.initial)
+		return nil
+	}
+
+	currentGateway, currentGw, err := getDefaultRouteInterface(m.routeDst, m.dsts[0], m.cfg.Table)
+	if err != nil {
+		return err
+	}
+	active := m.linkIndexVia(currentGateway, currentGw)
+	if active <= 0 {
+		return nil
+	}
+
+	cur := m.links[active]
+	m.log.Info("restoring default route to primary interface", "event", "restore", "from", cur.iface.Name, "to", primary.iface.Name, "gateway", primary.gw)
+	if err := m.switchRoute(active, 0); err != nil {
+		return err
+	}
+	m.setActive(primary.iface.Name, primary.gw)
+	return nil
+}
+
+// switchRoute moves the default route from the link at index from to the
+// link at index to, according to the configured mode. With --dry-run, the
+// changes are only logged.
+func (m *monitor) switchRoute(from, to int) error {
+	if m.cfg.Mode == "metric" {
+		return m.setRouteMetrics(to)
+	}
+	old, l := m.links[from], m.links[to]
+	for _, dst := range m.dsts {
+		if err := switchDefaultRoute(m.cfg.Mode, m.cfg.DryRun, m.cfg.Table, m.cfg.RouteProto, dst, old.iface, old.gw, l.iface, l.gw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setRouteMetrics installs the routes for --mode=metric to each of m's
+// destinations, preferring the link at index active; see
+// setDefaultRouteMetrics.
+func (m *monitor) setRouteMetrics(active int) error {
+	for _, dst := range m.dsts {
+		if err := setDefaultRouteMetrics(m.links, active, m.cfg.RouteMetric, m.cfg.Table, m.cfg.RouteProto, dst, m.cfg.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onSwitch runs any configured hooks and notifications after the default
+// route has been switched from one interface to another. The event is
+// either "failover" or "failback".
+func (m *monitor) onSwitch(event string, from *net.Interface, fromGw netip.Addr, to *net.Interface, toGw netip.Addr, reason string) {
+	hook := m.cfg.OnFailover
+	if event == "failback" {
+		hook = m.cfg.OnFailback
+	}
+	m.hooks.Add(1)
+	go func() {
+		defer m.hooks.Done()
+		runHook(m.log, hook, m.cfg.HookTimeout, m.group, m.cfg.Family, event, from, fromGw, to, toGw, reason)
+	}()
+
+	ev := webhookEvent{
+		Event:     event,
+		Group:     m.group,
+		Family:    m.cfg.Family,
+		Timestamp: time.Now(),
+		From:      from.Name,
+		To:        to.Name,
+		Reason:    reason,
+	}
+	m.mqtt.event(ev)
+	if m.cfg.WebhookURL != "" {
+		m.hooks.Add(1)
+		go func() {
+			defer m.hooks.Done()
+			sendWebhook(m.log, m.cfg.WebhookURL, m.cfg.WebhookHeaders, ev)
+		}()
+	}
+}
+
+// linkIndex returns the index of the link for the named interface, which may
+// also be given as configured, e.g. by MAC address, or -1 if it isn't one of
+// ours.
+func (m *monitor) linkIndex(name string) int {
+	for i, l := range m.links {
+		if l.iface.Name == name || l.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// linkIndexVia returns the index of the link for the named interface and
+// gateway gw. If there's none, it's the index of the first link for the
+// interface, or -1 if it isn't one of ours.
+func (m *monitor) linkIndexVia(name string, gw netip.Addr) int {
+	for i, l := range m.links {
+		if l.iface.Name == name && l.gw == gw {
+			return i
+		}
+	}
+	return m.linkIndex(name)
+}
+
+// refreshGateways re-runs autodetection for any gateways that weren't given
+// explicitly.
+func (m *monitor) refreshGateways() {
+	for _, l := range m.links {
+		if l.detectGw {
+			m.refreshGateway(l)
+		}
+	}
+}
+
+// refreshGateway re-runs autodetection for l's gateway, and updates it if
+// it's changed. If detection fails, the existing gateway is kept.
+func (m *monitor) refreshGateway(l *link) {
+	newGw, err := getGateway(l.iface, m.family, m.cfg.GatewayMethod)
+	if err != nil {
+		m.log.Error("error refreshing gateway; keeping current", "event", "gateway_refresh", "interface", l.iface.Name, "gateway", l.gw, "error", err)
+		return
+	}
+	if newGw == l.gw {
+		return
+	}
+
+	m.log.Info("gateway changed", "event", "gateway_changed", "interface", l.iface.Name, "old_gateway", l.gw, "gateway", newGw)
+	m.mu.Lock()
+	l.gw = newGw
+	m.mu.Unlock()
+
+	m.updateRuleRoutes(l)
+}
+
+// recordCheck records the result of a check via l that started at t.
+func (m *monitor) recordCheck(l *link, t time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l.lastCheck.IsZero() || (l.lastCheckErr == nil) != (err == nil) {
+		m.mqtt.statusChanged()
+	}
+	l.lastCheck = t
+	l.lastCheckErr = err
+	if err == nil {
+		if l.successes == 0 {
+			l.healthySince = t
+		}
+		l.failures = 0
+		l.successes++
+	} else {
+		l.successes = 0
+		l.failures++
+		if errors.Is(err, errNoCarrier) && l.failures < m.cfg.FailThreshold {
+			l.failures = m.cfg.FailThreshold
+		}
+	}
+}
+
+// setActive records that the named interface is carrying the default route,
+// via gw if it's valid, and only it; see setNexthops.
+func (m *monitor) setActive(name string, gw netip.Addr) {
+	m.mu.Lock()
+	if name != m.active || gw != m.activeGw {
+		m.mqtt.statusChanged()
+	}
+	m.accountActive(name)
+	m.active = name
+	m.activeGw = gw
+	m.nexthops = nil
+	m.mu.Unlock()
+
+	if i := m.linkIndexVia(name, gw); i >= 0 {
+		metricActiveInterface.WithLabelValues(m.name).Set(float64(i))
+	} else {
+		metricActiveInterface.WithLabelValues(m.name).Set(-1)
+	}
+}
+
+// backOff doubles the check interval, up to the maximum.
+func (m *monitor) backOff() {
+	next := m.interval * 2
+	if next > m.cfg.Check.MaxInterval {
+		next = m.cfg.Check.MaxInterval
+	}
+	if next != m.interval {
+		m.log.Info("primary still down; backing off", "event", "backoff", "interval", next)
+	}
+	m.interval = next
+}
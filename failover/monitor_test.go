@@ -0,0 +1,332 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	testPrimaryGw = netip.MustParseAddr("10.0.0.1")
+	testBackupGw  = netip.MustParseAddr("10.0.1.1")
+)
+
+// fakeChecker passes checks via every interface except those in down.
+type fakeChecker struct {
+	down map[string]bool
+}
+
+func (c fakeChecker) Check(ctx context.Context, iface *net.Interface) error {
+	if c.down[iface.Name] {
+		return errors.New("no reply")
+	}
+	return nil
+}
+
+// newTestMonitor returns a monitor for cfg with a link via testPrimary and
+// one via testBackup, checked by checker.
+func newTestMonitor(cfg *Config, checker Checker) *monitor {
+	return &monitor{
+		cfg:        cfg,
+		family:     netlink.FAMILY_V4,
+		checker:    checker,
+		log:        slog.Default(),
+		routeDst:   netip.MustParseAddr("8.8.8.8"),
+		dsts:       cfg.routeDsts(),
+		pinned:     -1,
+		interval:   cfg.Check.Interval,
+		counts:     make(map[string]int),
+		activeTime: make(map[string]time.Duration),
+		links: []*link{
+			{name: "wan0", iface: testPrimary, gw: testPrimaryGw},
+			{name: "wwan0", iface: testBackup, gw: testBackupGw},
+		},
+	}
+}
+
+func TestDoCheckOnce(t *testing.T) {
+	interval := DefaultConfig().Check.Interval
+
+	tests := []struct {
+		name  string
+		mode  string
+		table int
+		// routes are the default routes before the check, and down the
+		// interfaces checks fail via.
+		routes []netlink.Route
+		down   []string
+		// failures and successes are the primary's consecutive check
+		// results before the check.
+		failures, successes int
+		// want are the route changes made, wantActive the active
+		// interface afterwards, and wantInterval the time until the
+		// next check.
+		want         []string
+		wantActive   string
+		wantInterval time.Duration
+	}{
+		{
+			name:         "on primary and up",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on primary and failing",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}},
+			down:         []string{"wan0"},
+			failures:     1,
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on primary and down",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}},
+			down:         []string{"wan0"},
+			failures:     2,
+			want:         []string{"ip route replace default via 10.0.1.1 dev wwan0"},
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on primary and down, with delete-add",
+			mode:         "delete-add",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}},
+			down:         []string{"wan0"},
+			failures:     2,
+			want:         []string{"ip route del default via 10.0.0.1 dev wan0", "ip route add default via 10.0.1.1 dev wwan0"},
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			// Switching to a backup that's also down wouldn't help.
+			name:         "on primary and all down",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()}},
+			down:         []string{"wan0", "wwan0"},
+			failures:     2,
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on backup and up",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice()}},
+			down:         []string{"wan0"},
+			failures:     5,
+			wantActive:   "wwan0",
+			wantInterval: 2 * interval,
+		},
+		{
+			name:         "on backup and primary recovering",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice()}},
+			failures:     5,
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on backup and primary recovered",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice()}},
+			successes:    1,
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on backup and primary recovered, with delete-add",
+			mode:         "delete-add",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice()}},
+			successes:    1,
+			want:         []string{"ip route del default via 10.0.1.1 dev wwan0", "ip route add default via 10.0.0.1 dev wan0"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			// With --mode=metric, there's a default route via each
+			// link, and failing over swaps their metrics.
+			name: "on primary and down, with metric",
+			mode: "metric",
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice(), Priority: 50},
+				{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice(), Priority: 52},
+			},
+			down:     []string{"wan0"},
+			failures: 2,
+			want: []string{
+				"ip route replace default via 10.0.1.1 dev wwan0 metric 50",
+				"ip route replace default via 10.0.0.1 dev wan0 metric 51",
+				"ip route del default via 10.0.1.1 dev wwan0 metric 52",
+			},
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			name: "on backup and primary recovered, with metric",
+			mode: "metric",
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice(), Priority: 50},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice(), Priority: 51},
+			},
+			successes: 1,
+			want: []string{
+				"ip route replace default via 10.0.0.1 dev wan0 metric 50",
+				"ip route replace default via 10.0.1.1 dev wwan0 metric 52",
+				"ip route del default via 10.0.0.1 dev wan0 metric 51",
+			},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			// A default route via an interface that isn't one of ours
+			// is replaced with one via the highest-priority healthy
+			// link.
+			name:         "takeover",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testOther.Index, Gw: []byte{10, 0, 3, 1}}},
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "takeover with primary down",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testOther.Index, Gw: []byte{10, 0, 3, 1}}},
+			down:         []string{"wan0"},
+			want:         []string{"ip route replace default via 10.0.1.1 dev wwan0"},
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			name:   "takeover with metric",
+			mode:   "metric",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: testOther.Index, Gw: []byte{10, 0, 3, 1}}},
+			want: []string{
+				"ip route replace default via 10.0.0.1 dev wan0 metric 50",
+				"ip route replace default via 10.0.1.1 dev wwan0 metric 52",
+				"ip route del default via 10.0.0.1 dev wan0 metric 51",
+			},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "no default route",
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "no default route and primary down",
+			down:         []string{"wan0"},
+			want:         []string{"ip route replace default via 10.0.1.1 dev wwan0"},
+			wantActive:   "wwan0",
+			wantInterval: interval,
+		},
+		{
+			// The interface the default route was via has gone away,
+			// and its route is about to.
+			name:         "default route via missing interface",
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: 1 << 30, Gw: []byte{10, 0, 3, 1}}},
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			// A group's table starts out without a default route.
+			name:         "no default route in table",
+			table:        100,
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0 table 100"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+		{
+			name:         "on backup in table",
+			table:        100,
+			routes:       []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: testBackupGw.AsSlice(), Table: 100}},
+			successes:    1,
+			want:         []string{"ip route replace default via 10.0.0.1 dev wan0 table 100"},
+			wantActive:   "wan0",
+			wantInterval: interval,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeNetlink(t, tt.routes...)
+
+			cfg := DefaultConfig()
+			if tt.mode != "" {
+				cfg.Mode = tt.mode
+			}
+			cfg.Table = tt.table
+			down := make(map[string]bool)
+			for _, name := range tt.down {
+				down[name] = true
+			}
+			m := newTestMonitor(cfg, fakeChecker{down: down})
+			m.links[0].failures, m.links[0].successes = tt.failures, tt.successes
+
+			if err := m.doCheckOnce(context.Background()); err != nil {
+				t.Fatalf("doCheckOnce: %v", err)
+			}
+			var changes []string
+			for _, call := range f.takeCalls() {
+				if call != "ip route get 8.8.8.8" {
+					changes = append(changes, call)
+				}
+			}
+			if !slices.Equal(changes, tt.want) {
+				t.Errorf("route changes = %q; want %q", changes, tt.want)
+			}
+			if m.active != tt.wantActive {
+				t.Errorf("active = %s; want %s", m.active, tt.wantActive)
+			}
+			if m.interval != tt.wantInterval {
+				t.Errorf("interval = %v; want %v", m.interval, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestDoCheckOnceGateways(t *testing.T) {
+	// With two gateways on the primary interface, the default route via
+	// the second is recognized as its link's, and moves back to the first
+	// once it recovers.
+	gw2 := netip.MustParseAddr("10.0.0.2")
+	f := useFakeNetlink(t, netlink.Route{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw2.AsSlice()})
+	m := newTestMonitor(DefaultConfig(), fakeChecker{})
+	m.links = []*link{m.links[0], {name: "wan0", iface: testPrimary, gw: gw2}, m.links[1]}
+	m.links[0].successes = 1
+
+	if err := m.doCheckOnce(context.Background()); err != nil {
+		t.Fatalf("doCheckOnce: %v", err)
+	}
+	want := []string{"ip route get 8.8.8.8", "ip route replace default via 10.0.0.1 dev wan0"}
+	if got := f.takeCalls(); !slices.Equal(got, want) {
+		t.Errorf("calls = %q; want %q", got, want)
+	}
+	if m.active != "wan0" || m.activeGw != testPrimaryGw {
+		t.Errorf("active = %s via %v; want wan0 via %v", m.active, m.activeGw, testPrimaryGw)
+	}
+}
+
+func TestDoCheckOncePinned(t *testing.T) {
+	// A pinned default route stays put however the checks go.
+	f := useFakeNetlink(t, netlink.Route{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: testPrimaryGw.AsSlice()})
+	m := newTestMonitor(DefaultConfig(), fakeChecker{down: map[string]bool{"wan0": true}})
+	m.pinned = 0
+	for i := 0; i < m.cfg.FailThreshold+1; i++ {
+		if err := m.doCheckOnce(context.Background()); err != nil {
+			t.Fatalf("doCheckOnce: %v", err)
+		}
+	}
+	for _, call := range f.takeCalls() {
+		if call != "ip route get 8.8.8.8" {
+			t.Errorf("unexpected route change while pinned: %s", call)
+		}
+	}
+	if got := m.links[0].failures; got != m.cfg.FailThreshold+1 {
+		t.Errorf("primary failures = %d; want %d", got, m.cfg.FailThreshold+1)
+	}
+}
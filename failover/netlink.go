@@ -0,0 +1,53 @@
+package failover
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkOps is the subset of netlink operations used to inspect and change
+// the routing tables and policy routing rules, to inspect the neighbor
+// tables, and to inspect and set up or down network interfaces. All access to
+// them goes through nl, so that it can be replaced with a fake that doesn't
+// need root or a real network.
+type netlinkOps interface {
+	RouteGet(dst net.IP) ([]netlink.Route, error)
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+}
+
+// nl is the netlinkOps in use; by default, the real netlink in the current
+// network namespace.
+var nl netlinkOps = &netlink.Handle{}
+
+// interfaceByIndex looks up the interface that routes are via; by default,
+// it's net.InterfaceByIndex, but it's replaced along with nl.
+var interfaceByIndex = net.InterfaceByIndex
+
+// linkSubscribe subscribes to updates about network interfaces, like
+// netlink.LinkSubscribeWithOptions, which it is by default.
+var linkSubscribe = netlink.LinkSubscribeWithOptions
+
+// hasNetAdmin reports whether the process has CAP_NET_ADMIN in its effective
+// capability set, which changing routes, policy routing rules and interfaces
+// via netlink requires. If it can't be told, it's assumed to, so that the
+// netlink operations report any error themselves.
+func hasNetAdmin() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return true
+	}
+	return data[unix.CAP_NET_ADMIN/32].Effective&(1<<(unix.CAP_NET_ADMIN%32)) != 0
+}
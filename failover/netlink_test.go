@@ -0,0 +1,247 @@
+package failover
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The interfaces the fake netlink routes via. They only exist while it's in
+// use.
+var (
+	testPrimary = &net.Interface{Index: 101, Name: "wan0", MTU: 1500, Flags: net.FlagUp}
+	testBackup  = &net.Interface{Index: 102, Name: "wwan0", MTU: 1500, Flags: net.FlagUp}
+	testBackup2 = &net.Interface{Index: 103, Name: "lte0", MTU: 1500, Flags: net.FlagUp}
+	testOther   = &net.Interface{Index: 104, Name: "vpn0", MTU: 1400, Flags: net.FlagUp}
+
+	testInterfaces = []*net.Interface{testPrimary, testBackup, testBackup2, testOther}
+)
+
+// fakeNetlink is a netlinkOps that keeps the routing tables in memory, and
+// records each route lookup and change as the equivalent ip-route(8)
+// command. Its interfaces are always up with carrier, and have no
+// neighbors.
+type fakeNetlink struct {
+	mu     sync.Mutex
+	routes []netlink.Route
+	calls  []string
+}
+
+// useFakeNetlink replaces nl with a fakeNetlink holding routes, and the
+// system's interfaces with testInterfaces, until t ends.
+func useFakeNetlink(t *testing.T, routes ...netlink.Route) *fakeNetlink {
+	t.Helper()
+	f := &fakeNetlink{routes: routes}
+	prev, prevLookup := nl, interfaceByIndex
+	nl, interfaceByIndex = f, fakeInterfaceByIndex
+	t.Cleanup(func() { nl, interfaceByIndex = prev, prevLookup })
+	return f
+}
+
+// fakeInterfaceByIndex is like net.InterfaceByIndex, but for
+// testInterfaces.
+func fakeInterfaceByIndex(index int) (*net.Interface, error) {
+	for _, iface := range testInterfaces {
+		if iface.Index == index {
+			return iface, nil
+		}
+	}
+	return nil, fmt.Errorf("no such network interface with index %d", index)
+}
+
+// takeCalls returns the calls recorded since the last time it was called.
+func (f *fakeNetlink) takeCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// routeTable returns the table r is in, where zero means the main table.
+func routeTable(r netlink.Route) int {
+	if r.Table == 0 {
+		return syscall.RT_TABLE_MAIN
+	}
+	return r.Table
+}
+
+// routeFamily returns the netlink address family of r.
+func routeFamily(r netlink.Route) int {
+	switch {
+	case r.Dst != nil && r.Dst.IP.To4() == nil:
+		return netlink.FAMILY_V6
+	case r.Dst == nil && r.Gw != nil && r.Gw.To4() == nil:
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// sameRoute reports whether a and b are the same route as far as the kernel
+// is concerned: the same destination and metric in the same table.
+func sameRoute(a, b netlink.Route) bool {
+	if routeTable(a) != routeTable(b) || routeFamily(a) != routeFamily(b) || a.Priority != b.Priority {
+		return false
+	}
+	if isDefaultRoute(a) || isDefaultRoute(b) {
+		return isDefaultRoute(a) && isDefaultRoute(b)
+	}
+	return a.Dst.String() == b.Dst.String()
+}
+
+func (f *fakeNetlink) RouteGet(dst net.IP) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "ip route get "+dst.String())
+	family := netlink.FAMILY_V4
+	if dst.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	var best *netlink.Route
+	for i, r := range f.routes {
+		if routeTable(r) != syscall.RT_TABLE_MAIN || routeFamily(r) != family {
+			continue
+		}
+		if !isDefaultRoute(r) && !r.Dst.Contains(dst) {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = &f.routes[i]
+		}
+	}
+	if best == nil {
+		return nil, syscall.ENETUNREACH
+	}
+	// The kernel picks one of a multipath route's nexthops; this picks
+	// the first.
+	r := *best
+	if len(r.MultiPath) > 0 {
+		r.LinkIndex, r.Gw, r.MultiPath = r.MultiPath[0].LinkIndex, r.MultiPath[0].Gw, nil
+	}
+	return []netlink.Route{r}, nil
+}
+
+func (f *fakeNetlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	filter := &netlink.Route{}
+	var mask uint64
+	if link != nil {
+		filter.LinkIndex = link.Attrs().Index
+		mask = netlink.RT_FILTER_OIF
+	}
+	return f.RouteListFiltered(family, filter, mask)
+}
+
+// RouteListFiltered supports the table and output interface filters. Like
+// the real one, it lists only the main table unless the table is filtered
+// on, when a zero table lists all of them.
+func (f *fakeNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		if routeFamily(r) != family {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_TABLE == 0 {
+			if routeTable(r) != syscall.RT_TABLE_MAIN {
+				continue
+			}
+		} else if filter.Table != syscall.RT_TABLE_UNSPEC && routeTable(r) != filter.Table {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex {
+			continue
+		}
+		r.Table = routeTable(r)
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (f *fakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, ipRouteCommand("add", route))
+	for _, r := range f.routes {
+		if sameRoute(r, *route) {
+			return syscall.EEXIST
+		}
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+// RouteDel deletes the first route that's the same as route and, if route
+// has them, via the same interface and gateway and with the same protocol.
+func (f *fakeNetlink) RouteDel(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, ipRouteCommand("del", route))
+	for i, r := range f.routes {
+		if !sameRoute(r, *route) {
+			continue
+		}
+		if route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex {
+			continue
+		}
+		if route.Gw != nil && !r.Gw.Equal(route.Gw) {
+			continue
+		}
+		if route.Protocol != 0 && r.Protocol != route.Protocol {
+			continue
+		}
+		f.routes = append(f.routes[:i], f.routes[i+1:]...)
+		return nil
+	}
+	return syscall.ESRCH
+}
+
+func (f *fakeNetlink) RouteReplace(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, ipRouteCommand("replace", route))
+	for i, r := range f.routes {
+		if sameRoute(r, *route) {
+			f.routes[i] = *route
+			return nil
+		}
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+func (f *fakeNetlink) RuleAdd(rule *netlink.Rule) error { return nil }
+func (f *fakeNetlink) RuleDel(rule *netlink.Rule) error { return nil }
+
+func (f *fakeNetlink) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return nil, nil
+}
+
+func (f *fakeNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	iface, err := fakeInterfaceByIndex(index)
+	if err != nil {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Index = index
+	attrs.Name = iface.Name
+	attrs.RawFlags = unix.IFF_UP | unix.IFF_LOWER_UP
+	return &netlink.Device{LinkAttrs: attrs}, nil
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	for _, iface := range testInterfaces {
+		if iface.Name == name {
+			return f.LinkByIndex(iface.Index)
+		}
+	}
+	return nil, netlink.LinkNotFoundError{}
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error   { return nil }
+func (f *fakeNetlink) LinkSetDown(link netlink.Link) error { return nil }
@@ -0,0 +1,34 @@
+package failover
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the runtime profiling data of net/http/pprof under
+// /debug/pprof/ from ln until ctx is done, for debugging hangs and leaks in a
+// long-running instance. The handlers are only on this server, not on
+// http.DefaultServeMux's, which the other servers don't use anyway.
+func servePprof(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	serveHTTP(ctx, ln, mux)
+}
+
+// pprofListenAddr returns addr, the --pprof-addr, with the host defaulting to
+// localhost rather than every address, since the profiling data isn't meant
+// to be public: listening elsewhere must be asked for explicitly, e.g. with
+// "0.0.0.0:6060".
+func pprofListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
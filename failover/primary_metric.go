@@ -0,0 +1,98 @@
+package failover
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultRouteMetrics returns the lowest metric of the default routes in the
+// given routing table via each interface, by index. Metric-0 routes are
+// ignored, since the default route the monitor installs with --mode=replace
+// or delete-add doesn't set one, so those left are the ones set up for each
+// interface by e.g. its DHCP client.
+func defaultRouteMetrics(family, table int) (map[int]int, error) {
+	routes, err := tableRoutes(family, table)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[int]int)
+	for _, r := range routes {
+		if !isDefaultRoute(r) || r.Priority == 0 || len(r.MultiPath) > 0 {
+			continue
+		}
+		if cur, ok := metrics[r.LinkIndex]; !ok || r.Priority < cur {
+			metrics[r.LinkIndex] = r.Priority
+		}
+	}
+	return metrics, nil
+}
+
+// orderByMetric puts m's links in order of the metrics of their interfaces'
+// default routes, with --primary-by-metric, so that the primary interface is
+// whichever the system's configuration prefers, e.g. by DHCP-assigned
+// priorities, rather than a fixed one. Interfaces without a default route of
+// their own come after those with one, in their configured order. If the
+// primary changes, the failover logic then fails back to it once it passes
+// checks, as usual.
+func (m *monitor) orderByMetric() {
+	metrics, err := defaultRouteMetrics(m.family, m.cfg.Table)
+	if err != nil {
+		m.log.Warn("error reading default route metrics; keeping the current primary interface", "event", "error", "error", err)
+		return
+	}
+
+	configured := append([]string{m.cfg.Primary.Name}, backupNames(m.cfg)...)
+	links := slices.Clone(m.links)
+	slices.SortStableFunc(links, func(a, b *link) int {
+		ma, oka := metrics[a.iface.Index]
+		mb, okb := metrics[b.iface.Index]
+		switch {
+		case oka != okb:
+			if oka {
+				return -1
+			}
+			return 1
+		case ma != mb:
+			return ma - mb
+		}
+		return slices.Index(configured, a.name) - slices.Index(configured, b.name)
+	})
+	if slices.Equal(links, m.links) {
+		return
+	}
+
+	old := m.links[0]
+	m.mu.Lock()
+	if m.pinned >= 0 {
+		m.pinned = slices.Index(links, m.links[m.pinned])
+	}
+	m.links = links
+	m.mu.Unlock()
+
+	order := linkNames(links)
+	if links[0] != old {
+		m.log.Info("primary interface changed by route metric", "event", "primary_metric", "from", old.iface.Name, "to", links[0].iface.Name, "metric", metrics[links[0].iface.Index], "order", strings.Join(order, ","))
+	} else {
+		m.log.Info("backup interfaces reordered by route metric", "event", "primary_metric", "order", strings.Join(order, ","))
+	}
+}
+
+// primaryMetricInterval returns how often orderByMetric should be run, or
+// zero if it shouldn't.
+func (m *monitor) primaryMetricInterval() time.Duration {
+	if !m.cfg.PrimaryByMetric {
+		return 0
+	}
+	return m.cfg.PrimaryMetricInterval
+}
+
+// backupNames returns the configured names of cfg's backup interfaces, in
+// priority order.
+func backupNames(cfg *Config) []string {
+	names := make([]string, len(cfg.Backups))
+	for i, b := range cfg.Backups {
+		names[i] = b.Name
+	}
+	return names
+}
@@ -0,0 +1,300 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A reloadRequest asks a monitor's run loop to apply cfg, its failover
+// group's new configuration. The result is sent on reply.
+type reloadRequest struct {
+	cfg   *Config
+	reply chan error
+}
+
+// reloadConfig re-reads the configuration on SIGHUP, or when signalled
+// through cfg.Reload, as at startup, and applies it to monitors, which were
+// set up from cfg, the current configuration. Settings that can only be
+// changed by restarting, listed on Config, keep their current values with a
+// warning. If the new configuration is invalid, it's logged and cfg is kept;
+// otherwise the new one is returned.
+func reloadConfig(ctx context.Context, cfg *Config, monitors []*monitor) *Config {
+	slog.Info("reloading configuration", "event", "reload")
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+
+	newCfg, err := LoadConfig(cfg.args)
+	if err != nil {
+		slog.Error("invalid configuration; keeping the current one", "event", "error", "error", err)
+		return cfg
+	}
+	newCfg.Reload, newCfg.CheckNow = cfg.Reload, cfg.CheckNow
+
+	var kept []string
+	keep(&kept, "metrics_addr", cfg.MetricsAddr, &newCfg.MetricsAddr)
+	keep(&kept, "status_addr", cfg.StatusAddr, &newCfg.StatusAddr)
+	keep(&kept, "pprof_addr", cfg.PprofAddr, &newCfg.PprofAddr)
+	keep(&kept, "control_socket", cfg.ControlSocket, &newCfg.ControlSocket)
+	keep(&kept, "mqtt_broker", cfg.MQTTBroker, &newCfg.MQTTBroker)
+	keep(&kept, "mqtt_topic", cfg.MQTTTopic, &newCfg.MQTTTopic)
+	warnKept(slog.Default(), kept)
+
+	if loggingSetUp && (newCfg.LogFormat != cfg.LogFormat || newCfg.Verbosity != cfg.Verbosity || newCfg.LogDedupInterval != cfg.LogDedupInterval) {
+		SetupLogging(newCfg.LogFormat, newCfg.Verbosity, newCfg.LogDedupInterval)
+	}
+
+	groups := make(map[string]*Config, len(newCfg.groups))
+	for _, g := range newCfg.groups {
+		groups[g.id] = g
+	}
+	for _, m := range monitors {
+		g, ok := groups[m.name]
+		if !ok {
+			m.log.Warn("failover group removed from the configuration; it keeps running until restarted", "event", "reload")
+			continue
+		}
+		delete(groups, m.name)
+
+		req := reloadRequest{cfg: g, reply: make(chan error, 1)}
+		select {
+		case m.reload <- req:
+		case <-ctx.Done():
+			return newCfg
+		}
+		if err := <-req.reply; err != nil {
+			m.log.Error("error applying new configuration; keeping the current one", "event", "error", "error", err)
+		}
+	}
+	for name := range groups {
+		slog.Warn("adding a failover group requires a restart", "event", "reload", "group", name)
+	}
+	return newCfg
+}
+
+// keep records name in kept, and resets *new to old, if they differ, for
+// settings that can't be changed without restarting.
+func keep[T comparable](kept *[]string, name string, old T, new *T) {
+	if *new != old {
+		*kept = append(*kept, name)
+		*new = old
+	}
+}
+
+// warnKept warns about any settings that were kept by keep.
+func warnKept(log *slog.Logger, kept []string) {
+	if len(kept) > 0 {
+		log.Warn("changing settings requires a restart; keeping their current values", "event", "reload", "settings", strings.Join(kept, ", "))
+	}
+}
+
+// applyConfig switches m to cfg, its failover group's new configuration. The
+// interfaces are looked up again, gateways that aren't given explicitly are
+// redetected, and the check history of any links that are still there is
+// kept. On error, m is left as it was, unless the error was in reinstalling
+// the policy routing rules.
+func (m *monitor) applyConfig(cfg *Config) error {
+	var kept []string
+	keep(&kept, "family", m.cfg.Family, &cfg.Family)
+	keep(&kept, "table", m.cfg.Table, &cfg.Table)
+	keep(&kept, "mode", m.cfg.Mode, &cfg.Mode)
+	keep(&kept, "route_metric", m.cfg.RouteMetric, &cfg.RouteMetric)
+	keep(&kept, "route_proto", m.cfg.RouteProto, &cfg.RouteProto)
+	keep(&kept, "simulate", m.cfg.Simulate, &cfg.Simulate)
+	keep(&kept, "manage_backup_link", m.cfg.ManageBackupLink, &cfg.ManageBackupLink)
+	if !slices.Equal(cfg.RouteDst, m.cfg.RouteDst) {
+		kept = append(kept, "route_dst")
+		cfg.RouteDst = m.cfg.RouteDst
+	}
+	if cfg.Mode == "metric" {
+		// The metrics of the routes depend on the links' order.
+		keep(&kept, "primary", m.cfg.Primary, &cfg.Primary)
+		if !slices.Equal(cfg.Backups, m.cfg.Backups) {
+			kept = append(kept, "backups")
+			cfg.Backups = m.cfg.Backups
+		}
+	}
+	log := monitorLogger(cfg)
+	warnKept(log, kept)
+
+	var checker Checker
+	if m.sim == nil {
+		var err error
+		if checker, err = newChecker(&cfg.Check, m.family); err != nil {
+			return fmt.Errorf("creating checker: %w", err)
+		}
+	}
+	links, err := newGroupLinks(cfg, m.family, m.links)
+	if err != nil {
+		return err
+	}
+	if m.sim == nil {
+		if err := newLinkCheckers(cfg, m.family, links); err != nil {
+			return fmt.Errorf("creating checker: %w", err)
+		}
+	}
+	for _, l := range links {
+		for _, o := range m.links {
+			if l.iface.Name == o.iface.Name && l.gw == o.gw {
+				l.carryOver(o)
+				break
+			}
+		}
+	}
+
+	if m.sim != nil {
+		if err := m.sim.load(cfg.SimulateFile); err != nil {
+			return fmt.Errorf("loading simulate file: %w", err)
+		}
+	}
+
+	pinned := -1
+	if m.pinned >= 0 {
+		p := m.links[m.pinned]
+		for i, l := range links {
+			if l.iface.Name == p.iface.Name && l.gw == p.gw {
+				pinned = i
+				break
+			}
+		}
+		if pinned < 0 {
+			log.Warn("pinned interface removed from the configuration; returning to automatic failover", "event", "unpin", "interface", p.iface.Name)
+		}
+	}
+
+	m.removeRules()
+	m.mu.Lock()
+	m.links = links
+	m.pinned = pinned
+	m.mu.Unlock()
+	m.cfg = cfg
+	m.log = log
+	m.checker = checker
+	m.routeDst = checkDestination(&cfg.Check, m.family)
+	m.interval = cfg.Check.Interval
+	if cfg.PrimaryByMetric {
+		m.orderByMetric()
+	}
+	if err := m.installRules(); err != nil {
+		return fmt.Errorf("installing policy routing rules: %w", err)
+	}
+
+	if cfg.Mode == "metric" {
+		current, currentGw, err := getDefaultRouteInterface(m.routeDst, m.dsts[0], cfg.Table)
+		if err != nil {
+			return err
+		}
+		active := m.linkIndexVia(current, currentGw)
+		if active < 0 {
+			active = 0
+		}
+		if err := m.setRouteMetrics(active); err != nil {
+			return err
+		}
+	}
+
+	m.logConfig("reload")
+	return nil
+}
+
+// carryOver copies the check history of o, the link l replaces, to l. The
+// carrier state is only kept if it's still the same interface.
+func (l *link) carryOver(o *link) {
+	l.failures = o.failures
+	l.successes = o.successes
+	l.healthySince = o.healthySince
+	l.lastCheck = o.lastCheck
+	l.lastCheckErr = o.lastCheckErr
+	l.rtts = o.rtts
+	l.results = o.results
+	l.scoreRTTs = o.scoreRTTs
+	l.inRoute = o.inRoute
+	l.throughput = o.throughput
+	l.hasThroughput = o.hasThroughput
+	l.throughputTried = o.throughputTried
+	l.inbound = o.inbound
+	l.hasInbound = o.hasInbound
+	l.publicIP = o.publicIP
+	l.externalTried = o.externalTried
+	if l.iface.Index == o.iface.Index {
+		l.noCarrier = o.noCarrier
+		l.standby = o.standby
+		l.wokenAt = o.wokenAt
+	}
+}
+
+// logConfig logs m's effective configuration, with the gateways in use
+// filled in and the values of webhook headers and the MQTT broker's
+// password, which may hold credentials, redacted.
+func (m *monitor) logConfig(event string) {
+	cfg := *m.cfg
+	cfg.Primary.Gateway = m.gateways(cfg.Primary.Name)
+	cfg.Backups = slices.Clone(cfg.Backups)
+	for i := range cfg.Backups {
+		cfg.Backups[i].Gateway = m.gateways(cfg.Backups[i].Name)
+	}
+	cfg.WebhookHeaders = nil
+	for _, h := range m.cfg.WebhookHeaders {
+		name, _, _ := strings.Cut(h, ":")
+		cfg.WebhookHeaders = append(cfg.WebhookHeaders, name+": <redacted>")
+	}
+	cfg.MQTTBroker = redactURL(cfg.MQTTBroker)
+
+	s, err := configJSON(&cfg)
+	if err != nil {
+		m.log.Warn("error formatting configuration", "event", "error", "error", err)
+		return
+	}
+	m.log.Info("effective configuration", "event", event, "config", s)
+}
+
+// gateways returns the comma-separated gateways of m's links for the
+// interface with the given configured name.
+func (m *monitor) gateways(name string) string {
+	var gws []string
+	for _, l := range m.links {
+		if l.name == name {
+			gws = append(gws, l.gw.String())
+		}
+	}
+	return strings.Join(gws, ",")
+}
+
+// configJSON returns cfg in JSON on a single line, so that it's logged as one
+// message, with the config file's field names.
+func configJSON(cfg *Config) (string, error) {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	var v map[string]any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// monitorLogger returns the logger for the monitor configured by cfg, which
+// adds the failover group's name, if it has one, and with DualStack, the
+// address family, to each message.
+func monitorLogger(cfg *Config) *slog.Logger {
+	log := slog.Default()
+	if cfg.Name != "" {
+		log = log.With("group", cfg.Name)
+	}
+	if cfg.DualStack {
+		log = log.With("family", cfg.Family)
+	}
+	return log
+}
@@ -0,0 +1,441 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_, defaultDst4, _ = net.ParseCIDR("0.0.0.0/0")
+	_, defaultDst6, _ = net.ParseCIDR("::/0")
+)
+
+// defaultDst returns the default route destination for gw's address family.
+func defaultDst(gw netip.Addr) *net.IPNet {
+	if gw.Is6() {
+		return defaultDst6
+	}
+	return defaultDst4
+}
+
+// isRouteTo reports whether route is to dst, the destination of the routes
+// we manage: any default route, if dst is the default route destination, or
+// otherwise a route to exactly the prefix dst, from --route-dst.
+func isRouteTo(route netlink.Route, dst *net.IPNet) bool {
+	if ones, _ := dst.Mask.Size(); ones == 0 {
+		return isDefaultRoute(route)
+	}
+	return route.Dst != nil && route.Dst.String() == dst.String()
+}
+
+// dstFamily returns the netlink address family of dst.
+func dstFamily(dst *net.IPNet) int {
+	if dst.IP.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// routeReplace, routeAdd and routeDel change the routing table like the
+// netlink functions of the same names. With dryRun, they only log the
+// equivalent ip-route(8) command instead. Errors are wrapped by routeError.
+func routeReplace(r *netlink.Route, dryRun bool) error {
+	return routeChange("replace", nl.RouteReplace, r, dryRun)
+}
+
+func routeAdd(r *netlink.Route, dryRun bool) error {
+	return routeChange("add", nl.RouteAdd, r, dryRun)
+}
+
+func routeDel(r *netlink.Route, dryRun bool) error {
+	return routeChange("del", nl.RouteDel, r, dryRun)
+}
+
+func routeChange(op string, fn func(*netlink.Route) error, r *netlink.Route, dryRun bool) error {
+	cmd := ipRouteCommand(op, r)
+	if dryRun {
+		slog.Info("dry run; not changing route", "event", "dry_run", "command", cmd, "link_index", r.LinkIndex)
+		return nil
+	}
+	slog.Debug("changing route", "event", "route_change", "command", cmd)
+	if err := fn(r); err != nil {
+		return routeError(cmd, err)
+	}
+	return nil
+}
+
+// routeErrorHints explain the errors the kernel commonly gives for route
+// changes, which say little about the cause on their own.
+var routeErrorHints = map[syscall.Errno]string{
+	syscall.EEXIST:      "there's already a route to the same destination with the same metric",
+	syscall.ESRCH:       "there's no such route",
+	syscall.ENETUNREACH: "the gateway isn't on any of the interface's subnets, or the interface is down",
+	syscall.ENODEV:      "the interface no longer exists",
+	syscall.EPERM:       "changing routes requires root or CAP_NET_ADMIN",
+	syscall.EINVAL:      "the kernel rejected the route, e.g. for a gateway of the wrong address family",
+}
+
+// routeError returns err, from a route change, with cmd, the equivalent
+// ip-route(8) command, so that it's clear which route and interface it was
+// about, and for common errors, an explanation.
+func routeError(cmd string, err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if hint, ok := routeErrorHints[errno]; ok {
+			return fmt.Errorf("%s: %w (%s)", cmd, err, hint)
+		}
+	}
+	return fmt.Errorf("%s: %w", cmd, err)
+}
+
+// ipRouteCommand formats r as an ip-route(8) command performing op, e.g.
+// "ip route replace default via 10.0.0.1 dev eth0".
+func ipRouteCommand(op string, r *netlink.Route) string {
+	var b strings.Builder
+	b.WriteString("ip ")
+	if r.Dst != nil && r.Dst.IP.To4() == nil {
+		b.WriteString("-6 ")
+	}
+	b.WriteString("route " + op)
+
+	if isDefaultRoute(*r) {
+		b.WriteString(" default")
+	} else {
+		b.WriteString(" " + r.Dst.String())
+	}
+	if len(r.MultiPath) == 0 {
+		writeNexthop(&b, r.Gw, r.LinkIndex)
+	}
+	if r.Src != nil {
+		b.WriteString(" src " + r.Src.String())
+	}
+	if r.Protocol != 0 {
+		fmt.Fprintf(&b, " proto %d", r.Protocol)
+	}
+	if r.Priority != 0 {
+		fmt.Fprintf(&b, " metric %d", r.Priority)
+	}
+	if r.Table != 0 && r.Table != syscall.RT_TABLE_MAIN {
+		fmt.Fprintf(&b, " table %d", r.Table)
+	}
+	if r.MTU != 0 {
+		fmt.Fprintf(&b, " mtu %d", r.MTU)
+	}
+	if r.AdvMSS != 0 {
+		fmt.Fprintf(&b, " advmss %d", r.AdvMSS)
+	}
+	if r.Hoplimit != 0 {
+		fmt.Fprintf(&b, " hoplimit %d", r.Hoplimit)
+	}
+	for _, nh := range r.MultiPath {
+		b.WriteString(" nexthop")
+		writeNexthop(&b, nh.Gw, nh.LinkIndex)
+		fmt.Fprintf(&b, " weight %d", nh.Hops+1)
+	}
+	return b.String()
+}
+
+// writeNexthop writes the "via" and "dev" arguments of an ip-route(8) command
+// for a route, or a nexthop of a multipath route, via gw and the interface
+// with the given index.
+func writeNexthop(b *strings.Builder, gw net.IP, linkIndex int) {
+	if gw != nil {
+		b.WriteString(" via " + gw.String())
+	}
+	if iface, err := interfaceByIndex(linkIndex); err == nil {
+		b.WriteString(" dev " + iface.Name)
+	} else {
+		fmt.Fprintf(b, " dev if%d", linkIndex)
+	}
+}
+
+// switchDefaultRoute moves the default route in the given routing table (or
+// the main table, if zero) from oldDev to newDev, marking it with the given
+// route protocol, if it's non-zero. Unless mode is
+// "delete-add", the route is replaced in a single netlink operation, so
+// there's always exactly one default route and never a window without one,
+// even if the old route has already gone away. The route is to dst, which is
+// normally the default route destination; see Config.RouteDst.
+func switchDefaultRoute(mode string, dryRun bool, table, proto int, dst *net.IPNet, oldDev *net.Interface, oldGw netip.Addr, newDev *net.Interface, newGw netip.Addr) error {
+	if mode == "delete-add" {
+		return switchDefaultRouteDeleteAdd(dryRun, table, proto, dst, oldDev, oldGw, newDev, newGw)
+	}
+
+	err := routeReplace(withRouteAttrs(&netlink.Route{
+		Dst:       dst,             // "default"
+		LinkIndex: newDev.Index,    // "dev primary"
+		Gw:        newGw.AsSlice(), // "via 5.6.7.8"
+		Table:     table,
+		Protocol:  proto,
+	}, newDev), dryRun)
+	if err != nil {
+		return fmt.Errorf("replacing default route via %s (%v) with %s (%v): %w", oldDev.Name, oldGw, newDev.Name, newGw, err)
+	}
+	return nil
+}
+
+// setDefaultRoute replaces the default route, or the route to dst, in the
+// given routing table, whichever interface it's via, with one via dev and gw,
+// marked with the given route protocol, if it's non-zero.
+func setDefaultRoute(dryRun bool, table, proto int, dst *net.IPNet, dev *net.Interface, gw netip.Addr) error {
+	err := routeReplace(withRouteAttrs(&netlink.Route{
+		Dst:       dst,
+		LinkIndex: dev.Index,
+		Gw:        gw.AsSlice(),
+		Table:     table,
+		Protocol:  proto,
+	}, dev), dryRun)
+	if err != nil {
+		return fmt.Errorf("setting default route via %s (%v): %w", dev.Name, gw, err)
+	}
+	return nil
+}
+
+// switchDefaultRouteDeleteAdd moves the default route from oldDev to newDev
+// by deleting the old route and then adding the new one. There's briefly no
+// default route at all, so this is only used if explicitly requested.
+func switchDefaultRouteDeleteAdd(dryRun bool, table, proto int, dst *net.IPNet, oldDev *net.Interface, oldGw netip.Addr, newDev *net.Interface, newGw netip.Addr) error {
+	// Read the old route's attributes before it's gone.
+	r := withRouteAttrs(&netlink.Route{
+		Dst:       dst,             // "default"
+		LinkIndex: newDev.Index,    // "dev primary"
+		Gw:        newGw.AsSlice(), // "via 5.6.7.8"
+		Table:     table,
+		Protocol:  proto,
+	}, newDev)
+	old := &netlink.Route{
+		Dst:       dst,             // "default"
+		LinkIndex: oldDev.Index,    // "dev backup"
+		Gw:        oldGw.AsSlice(), // "via 1.2.3.4"
+		Table:     table,
+		Protocol:  proto,
+	}
+	err := routeDel(old, dryRun)
+	if proto != 0 && errors.Is(err, syscall.ESRCH) {
+		// The old route is someone else's, e.g. from DHCP, rather
+		// than one we installed with our protocol; it's still the one
+		// to remove, or adding ours would clash with it.
+		old.Protocol = 0
+		err = routeDel(old, dryRun)
+	}
+	if err != nil {
+		slog.Error("error removing old default route", "event", "error", "interface", oldDev.Name, "gateway", oldGw, "error", err)
+	}
+	if err := routeAdd(r, dryRun); err != nil {
+		return fmt.Errorf("adding default route via %s (%v): %w", newDev.Name, newGw, err)
+	}
+	return nil
+}
+
+// withRouteAttrs copies the attributes of the preferred route to r's
+// destination in r's table, which r is to take the place of via dev, to r,
+// so that they aren't lost in the switch: its protocol, unless r has its
+// own, MTU, advertised MSS and hop limit, and its preferred source address,
+// if that's also assigned to dev. Only the nexthop is r's own. It returns r.
+func withRouteAttrs(r *netlink.Route, dev *net.Interface) *netlink.Route {
+	cur, err := preferredDefaultRoute(r.Dst, r.Table)
+	if err != nil {
+		slog.Warn("error reading the current default route; replacing it without its attributes", "event", "error", "error", err)
+		return r
+	} else if cur == nil || (cur.Type != 0 && cur.Type != unix.RTN_UNICAST) {
+		// There's nothing to carry over from e.g. an unreachable
+		// route.
+		return r
+	}
+
+	if r.Protocol == 0 {
+		r.Protocol = cur.Protocol
+	}
+	r.MTU = cur.MTU
+	r.AdvMSS = cur.AdvMSS
+	r.Hoplimit = cur.Hoplimit
+	if cur.Src != nil && hasAddr(dev, cur.Src) {
+		r.Src = cur.Src
+	}
+	return r
+}
+
+// hasAddr reports whether ip is assigned to iface.
+func hasAddr(iface *net.Interface, ip net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaultRouteMetrics is used with --mode=metric. Rather than keeping a
+// single default route in the given routing table (or the main table, if
+// zero), it installs one via each of links: the link at index
+// active gets metric base, and every other link gets base+1+i, so that the
+// kernel prefers the active link and then the rest in priority order. The
+// active link's route is replaced in place of the previously-active one, so
+// there's never a window without a preferred default route.
+//
+// Only routes with these metrics are touched. Default routes installed by
+// anything else (e.g. a DHCP client) are left alone; if they have a lower
+// metric than base, the kernel will prefer them over ours. The routes are
+// marked with the given route protocol, if it's non-zero.
+func setDefaultRouteMetrics(links []*link, active, base, table, proto int, dst *net.IPNet, dryRun bool) error {
+	l := links[active]
+	err := routeReplace(&netlink.Route{
+		Dst:       dst,
+		LinkIndex: l.iface.Index,
+		Gw:        l.gw.AsSlice(),
+		Priority:  base,
+		Table:     table,
+		Protocol:  proto,
+	}, dryRun)
+	if err != nil {
+		return fmt.Errorf("setting default route via %s (%v) with metric %d: %w", l.iface.Name, l.gw, base, err)
+	}
+
+	for i, o := range links {
+		if i == active {
+			continue
+		}
+		err := routeReplace(&netlink.Route{
+			Dst:       dst,
+			LinkIndex: o.iface.Index,
+			Gw:        o.gw.AsSlice(),
+			Priority:  base + 1 + i,
+			Table:     table,
+			Protocol:  proto,
+		}, dryRun)
+		if err != nil {
+			return fmt.Errorf("setting default route via %s (%v) with metric %d: %w", o.iface.Name, o.gw, base+1+i, err)
+		}
+	}
+
+	// The active link doesn't need its lower-priority route any more.
+	err = routeDel(&netlink.Route{
+		Dst:       dst,
+		LinkIndex: l.iface.Index,
+		Gw:        l.gw.AsSlice(),
+		Priority:  base + 1 + active,
+		Table:     table,
+		Protocol:  proto,
+	}, dryRun)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("removing default route via %s with metric %d: %w", l.iface.Name, base+1+active, err)
+	}
+	return nil
+}
+
+// shadowingDefaultRoutes returns any routes to dst in the given routing table
+// (or the main table, if zero) with a lower metric than base, which the
+// kernel would prefer over those installed by setDefaultRouteMetrics.
+func shadowingDefaultRoutes(dst *net.IPNet, base, table int) ([]netlink.Route, error) {
+	routes, err := tableRoutes(dstFamily(dst), table)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []netlink.Route
+	for _, route := range routes {
+		if isRouteTo(route, dst) && route.Priority < base {
+			ret = append(ret, route)
+		}
+	}
+	return ret, nil
+}
+
+// tableRoutes returns the routes in the given routing table, or the main
+// table if it's zero.
+func tableRoutes(family, table int) ([]netlink.Route, error) {
+	if table == 0 {
+		return nl.RouteList(nil, family)
+	}
+	return nl.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+}
+
+// getDefaultRouteInterface returns the name of the interface that the kernel
+// routes packets to dst via, which is normally the interface carrying the
+// default route, and the gateway, if any.
+//
+// With a non-zero table, or a prefix other than the default route
+// destination, it's instead the interface of the preferred route to prefix in
+// that table, whatever rules select it.
+//
+// If there's no valid default route, the name is empty. That's the case if
+// there's none yet, or if the interface it was via has gone away, e.g. a USB
+// modem being unplugged, which also removes its routes.
+func getDefaultRouteInterface(dst netip.Addr, prefix *net.IPNet, table int) (string, netip.Addr, error) {
+	if ones, _ := prefix.Mask.Size(); table != 0 || ones != 0 {
+		return getTableDefaultRoute(prefix, table)
+	}
+
+	routes, err := nl.RouteGet(dst.AsSlice())
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return "", netip.Addr{}, nil
+	} else if err != nil {
+		return "", netip.Addr{}, err
+	}
+	if len(routes) == 0 {
+		return "", netip.Addr{}, nil
+	}
+
+	iface, err := interfaceByIndex(routes[0].LinkIndex)
+	if err != nil {
+		slog.Debug("default route is via a missing interface", "event", "route_lookup", "link_index", routes[0].LinkIndex, "error", err)
+		return "", netip.Addr{}, nil
+	}
+
+	gw, _ := netip.AddrFromSlice(routes[0].Gw)
+	return iface.Name, gw.Unmap(), nil
+}
+
+// preferredDefaultRoute returns the route to dst, normally the default route,
+// with the lowest metric in the given routing table (or the main table, if
+// zero), or nil if there's none.
+func preferredDefaultRoute(dst *net.IPNet, table int) (*netlink.Route, error) {
+	routes, err := tableRoutes(dstFamily(dst), table)
+	if err != nil {
+		return nil, err
+	}
+	var best *netlink.Route
+	for i, route := range routes {
+		if isRouteTo(route, dst) && (best == nil || route.Priority < best.Priority) {
+			best = &routes[i]
+		}
+	}
+	return best, nil
+}
+
+// getTableDefaultRoute returns the interface and gateway of the route to dst,
+// normally the default route, with the lowest metric in the given routing
+// table, or an empty name if there's none.
+func getTableDefaultRoute(dst *net.IPNet, table int) (string, netip.Addr, error) {
+	best, err := preferredDefaultRoute(dst, table)
+	if err != nil {
+		return "", netip.Addr{}, err
+	} else if best == nil {
+		return "", netip.Addr{}, nil
+	}
+
+	// For a multipath route, use the first nexthop.
+	index, gwIP := best.LinkIndex, best.Gw
+	if len(best.MultiPath) > 0 {
+		index, gwIP = best.MultiPath[0].LinkIndex, best.MultiPath[0].Gw
+	}
+	iface, err := interfaceByIndex(index)
+	if err != nil {
+		slog.Debug("default route is via a missing interface", "event", "route_lookup", "link_index", index, "table", table, "error", err)
+		return "", netip.Addr{}, nil
+	}
+	gw, _ := netip.AddrFromSlice(gwIP)
+	return iface.Name, gw.Unmap(), nil
+}
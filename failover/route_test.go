@@ -0,0 +1,314 @@
+package failover
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestSwitchDefaultRoute(t *testing.T) {
+	oldGw, newGw := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+
+	tests := []struct {
+		name   string
+		mode   string
+		dryRun bool
+		table  int
+		proto  int
+		// dst is the destination of the route to switch, if it isn't
+		// the default route.
+		dst *net.IPNet
+		// routes are the routes before the switch, want the route
+		// changes made, and wantDev the interface the default route is
+		// via afterwards.
+		routes  []netlink.Route
+		want    []string
+		wantDev string
+	}{
+		{
+			name:    "replace",
+			mode:    "replace",
+			routes:  []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()}},
+			want:    []string{"ip route replace default via 10.0.0.2 dev wwan0"},
+			wantDev: "wwan0",
+		},
+		{
+			name:    "delete-add",
+			mode:    "delete-add",
+			routes:  []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()}},
+			want:    []string{"ip route del default via 10.0.0.1 dev wan0", "ip route add default via 10.0.0.2 dev wwan0"},
+			wantDev: "wwan0",
+		},
+		{
+			// The route we install is marked with our protocol,
+			// rather than the one it replaces.
+			name:    "replace with proto",
+			mode:    "replace",
+			proto:   200,
+			routes:  []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice(), Protocol: 16}},
+			want:    []string{"ip route replace default via 10.0.0.2 dev wwan0 proto 200"},
+			wantDev: "wwan0",
+		},
+		{
+			// Only the route to dst is switched, not the default
+			// route.
+			name: "replace route dst",
+			mode: "replace",
+			dst:  prefix,
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testBackup2.Index, Gw: oldGw.AsSlice()},
+				{Dst: prefix, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()},
+			},
+			want:    []string{"ip route replace 192.0.2.0/24 via 10.0.0.2 dev wwan0"},
+			wantDev: "wwan0",
+		},
+		{
+			name:  "replace in table",
+			mode:  "replace",
+			table: 100,
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice(), Table: 100},
+			},
+			want:    []string{"ip route replace default via 10.0.0.2 dev wwan0 table 100"},
+			wantDev: "wwan0",
+		},
+		{
+			name:  "delete-add in table",
+			mode:  "delete-add",
+			table: 100,
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice(), Table: 100},
+			},
+			want:    []string{"ip route del default via 10.0.0.1 dev wan0 table 100", "ip route add default via 10.0.0.2 dev wwan0 table 100"},
+			wantDev: "wwan0",
+		},
+		{
+			// The old route isn't marked with our protocol, but
+			// it's still deleted, rather than left to clash with
+			// ours.
+			name:   "delete-add with proto",
+			mode:   "delete-add",
+			proto:  200,
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice(), Protocol: 16}},
+			want: []string{
+				"ip route del default via 10.0.0.1 dev wan0 proto 200",
+				"ip route del default via 10.0.0.1 dev wan0",
+				"ip route add default via 10.0.0.2 dev wwan0 proto 200",
+			},
+			wantDev: "wwan0",
+		},
+		{
+			// If the old route has already gone away, deleting it
+			// fails, but the new one is still added.
+			name:    "delete-add with delete failing",
+			mode:    "delete-add",
+			want:    []string{"ip route del default via 10.0.0.1 dev wan0", "ip route add default via 10.0.0.2 dev wwan0"},
+			wantDev: "wwan0",
+		},
+		{
+			name:    "dry run",
+			mode:    "replace",
+			dryRun:  true,
+			routes:  []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()}},
+			wantDev: "wan0",
+		},
+		{
+			name:    "dry run delete-add",
+			mode:    "delete-add",
+			dryRun:  true,
+			routes:  []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: oldGw.AsSlice()}},
+			wantDev: "wan0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeNetlink(t, tt.routes...)
+			dst := tt.dst
+			if dst == nil {
+				dst = defaultDst4
+			}
+			if err := switchDefaultRoute(tt.mode, tt.dryRun, tt.table, tt.proto, dst, testPrimary, oldGw, testBackup, newGw); err != nil {
+				t.Fatalf("switchDefaultRoute: %v", err)
+			}
+			if got := f.takeCalls(); !slices.Equal(got, tt.want) {
+				t.Errorf("route changes = %q; want %q", got, tt.want)
+			}
+			dev, _, err := getDefaultRouteInterface(netip.MustParseAddr("8.8.8.8"), dst, tt.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != tt.wantDev {
+				t.Errorf("default route via %s; want %s", dev, tt.wantDev)
+			}
+		})
+	}
+}
+
+func TestSetDefaultRouteMetrics(t *testing.T) {
+	links := []*link{
+		{iface: testPrimary, gw: netip.MustParseAddr("10.0.0.1")},
+		{iface: testBackup, gw: netip.MustParseAddr("10.0.1.1")},
+		{iface: testBackup2, gw: netip.MustParseAddr("10.0.2.1")},
+	}
+
+	tests := []struct {
+		name   string
+		active int
+		// want are the route changes made, and wantDev the interface
+		// the kernel prefers afterwards.
+		want    []string
+		wantDev string
+	}{
+		{
+			name:   "primary",
+			active: 0,
+			want: []string{
+				"ip route replace default via 10.0.0.1 dev wan0 metric 50",
+				"ip route replace default via 10.0.1.1 dev wwan0 metric 52",
+				"ip route replace default via 10.0.2.1 dev lte0 metric 53",
+				"ip route del default via 10.0.0.1 dev wan0 metric 51",
+			},
+			wantDev: "wan0",
+		},
+		{
+			// The rest keep their priority order behind the active
+			// link, which gives up its own lower-priority route.
+			name:   "second backup",
+			active: 2,
+			want: []string{
+				"ip route replace default via 10.0.2.1 dev lte0 metric 50",
+				"ip route replace default via 10.0.0.1 dev wan0 metric 51",
+				"ip route replace default via 10.0.1.1 dev wwan0 metric 52",
+				"ip route del default via 10.0.2.1 dev lte0 metric 53",
+			},
+			wantDev: "lte0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start with the primary active, and routes via the backups
+			// behind it, plus one via an unmanaged interface with a
+			// higher metric that's left alone.
+			f := useFakeNetlink(t,
+				netlink.Route{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: links[0].gw.AsSlice(), Priority: 50},
+				netlink.Route{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: links[1].gw.AsSlice(), Priority: 52},
+				netlink.Route{Dst: defaultDst4, LinkIndex: testBackup2.Index, Gw: links[2].gw.AsSlice(), Priority: 53},
+				netlink.Route{Dst: defaultDst4, LinkIndex: testOther.Index, Gw: []byte{10, 0, 3, 1}, Priority: 100},
+			)
+			if err := setDefaultRouteMetrics(links, tt.active, 50, 0, 0, defaultDst4, false); err != nil {
+				t.Fatalf("setDefaultRouteMetrics: %v", err)
+			}
+			if got := f.takeCalls(); !slices.Equal(got, tt.want) {
+				t.Errorf("route changes = %q; want %q", got, tt.want)
+			}
+			if len(f.routes) != 4 {
+				t.Errorf("got %d routes; want 4: %v", len(f.routes), f.routes)
+			}
+			dev, _, err := getDefaultRouteInterface(netip.MustParseAddr("8.8.8.8"), defaultDst4, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != tt.wantDev {
+				t.Errorf("default route via %s; want %s", dev, tt.wantDev)
+			}
+		})
+	}
+}
+
+func TestGetDefaultRouteInterface(t *testing.T) {
+	gw, gw2 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+	dst := netip.MustParseAddr("8.8.8.8")
+
+	tests := []struct {
+		name   string
+		routes []netlink.Route
+		prefix *net.IPNet
+		table  int
+		want   string
+		wantGw netip.Addr
+	}{
+		{
+			name:   "default route",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw.AsSlice()}},
+			want:   "wan0",
+			wantGw: gw,
+		},
+		{
+			name: "lowest metric",
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw.AsSlice(), Priority: 20},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw2.AsSlice(), Priority: 10},
+			},
+			want:   "wan0",
+			wantGw: gw2,
+		},
+		{
+			name:   "no gateway",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: testBackup.Index}},
+			want:   "wwan0",
+		},
+		{
+			name: "no default route",
+		},
+		{
+			// The interface has gone away, but its route hasn't yet.
+			name:   "missing interface",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: 1 << 30, Gw: gw.AsSlice()}},
+		},
+		{
+			name:   "missing interface in table",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: 1 << 30, Gw: gw.AsSlice(), Table: 100}},
+			table:  100,
+		},
+		{
+			// Only table 100 is looked at, and the lowest metric wins.
+			name: "table",
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testBackup.Index, Gw: gw.AsSlice()},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw.AsSlice(), Table: 100, Priority: 20},
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw2.AsSlice(), Table: 100, Priority: 10},
+			},
+			table:  100,
+			want:   "wan0",
+			wantGw: gw2,
+		},
+		{
+			name:   "no route in table",
+			routes: []netlink.Route{{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw.AsSlice()}},
+			table:  100,
+		},
+		{
+			name: "route dst",
+			routes: []netlink.Route{
+				{Dst: defaultDst4, LinkIndex: testPrimary.Index, Gw: gw.AsSlice()},
+				{Dst: prefix, LinkIndex: testBackup.Index, Gw: gw2.AsSlice()},
+			},
+			prefix: prefix,
+			want:   "wwan0",
+			wantGw: gw2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeNetlink(t, tt.routes...)
+			prefix := tt.prefix
+			if prefix == nil {
+				prefix = defaultDst4
+			}
+			got, gotGw, err := getDefaultRouteInterface(dst, prefix, tt.table)
+			if err != nil {
+				t.Fatalf("getDefaultRouteInterface: %v", err)
+			}
+			if got != tt.want || gotGw != tt.wantGw {
+				t.Errorf("getDefaultRouteInterface = %q, %v; want %q, %v", got, gotGw, tt.want, tt.wantGw)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RuleConfig configures a policy routing rule that sends matching traffic out
+// of a specific interface regardless of failover, via a default route in a
+// dedicated routing table.
+type RuleConfig struct {
+	// Interface is the primary or backup interface to send traffic via.
+	Interface string `yaml:"interface"`
+	// From is the source prefix to match, if any.
+	From string `yaml:"from"`
+	// Mark is the firewall mark to match, if non-zero.
+	Mark uint32 `yaml:"mark"`
+	// Table is the routing table to install the interface's default
+	// route in. It shouldn't be used by anything else.
+	Table int `yaml:"table"`
+	// Priority is the rule's priority; if zero, the kernel picks one.
+	Priority int `yaml:"priority"`
+}
+
+// parseRule parses a --rule flag value, a comma-separated list of key=value
+// pairs whose keys are the yaml names of RuleConfig's fields, e.g.
+// "interface=wwan0,from=10.5.0.0/24,table=100".
+func parseRule(s string) (RuleConfig, error) {
+	var r RuleConfig
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return r, fmt.Errorf("invalid rule %q: expected key=value, got %q", s, kv)
+		}
+
+		var err error
+		switch k {
+		case "interface":
+			r.Interface = v
+		case "from":
+			r.From = v
+		case "mark":
+			var mark uint64
+			mark, err = strconv.ParseUint(v, 0, 32)
+			r.Mark = uint32(mark)
+		case "table":
+			r.Table, err = strconv.Atoi(v)
+		case "priority":
+			r.Priority, err = strconv.Atoi(v)
+		default:
+			return r, fmt.Errorf("invalid rule %q: unknown key %q", s, k)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid rule %q: bad %s: %w", s, k, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *RuleConfig) validate() error {
+	if r.Interface == "" {
+		return errors.New("rule has no interface")
+	} else if r.From == "" && r.Mark == 0 {
+		return fmt.Errorf("rule for %s must match on a source prefix, a mark, or both", r.Interface)
+	}
+	if r.From != "" {
+		if _, _, err := net.ParseCIDR(r.From); err != nil {
+			return fmt.Errorf("rule for %s: invalid source prefix: %w", r.Interface, err)
+		}
+	}
+
+	switch r.Table {
+	case 0:
+		return fmt.Errorf("rule for %s has no table", r.Interface)
+	case syscall.RT_TABLE_MAIN, syscall.RT_TABLE_LOCAL, syscall.RT_TABLE_DEFAULT:
+		return fmt.Errorf("rule for %s can't use the kernel's built-in table %d", r.Interface, r.Table)
+	}
+	return nil
+}
+
+// netlinkRule returns the netlink rule for r in the given address family.
+func (r *RuleConfig) netlinkRule(family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = r.Table
+	if r.From != "" {
+		_, rule.Src, _ = net.ParseCIDR(r.From)
+	}
+	if r.Mark != 0 {
+		rule.Mark = int(r.Mark)
+	}
+	if r.Priority != 0 {
+		rule.Priority = r.Priority
+	}
+	return rule
+}
+
+// assignCheckTables assigns successive routing tables, starting at base, to
+// each of links whose interface has other links with different gateways, so
+// that checks via them can be routed via their gateway.
+func assignCheckTables(links []*link, base int) {
+	table := base
+	for i, l := range links {
+		for j, o := range links {
+			if i != j && l.iface == o.iface {
+				l.checkTable = table
+				l.fwmark = uint32(table)
+				table++
+				break
+			}
+		}
+	}
+}
+
+// checkRule returns the rule sending checks via l to its check table.
+func (m *monitor) checkRule(l *link) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = m.family
+	rule.Table = l.checkTable
+	rule.Mark = l.checkTable
+	return rule
+}
+
+// installRules installs the configured policy routing rules, along with the
+// default route in each one's table, and the rules and routes for checking
+// the gateways of interfaces with several.
+func (m *monitor) installRules() error {
+	for _, l := range m.links {
+		if l.checkTable == 0 {
+			continue
+		}
+		err := routeReplace(&netlink.Route{
+			Dst:       defaultDst(l.gw),
+			LinkIndex: l.iface.Index,
+			Gw:        l.gw.AsSlice(),
+			Table:     l.checkTable,
+			Protocol:  m.cfg.RouteProto,
+		}, m.cfg.DryRun)
+		if err != nil {
+			return fmt.Errorf("installing check route via %s (%v) in table %d: %w", l.iface.Name, l.gw, l.checkTable, err)
+		}
+		err = ruleChange("add", nl.RuleAdd, m.checkRule(l), m.cfg.DryRun)
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("adding check rule for %s (%v): %w", l.iface.Name, l.gw, err)
+		}
+	}
+
+	for i := range m.cfg.Rules {
+		r := &m.cfg.Rules[i]
+		if err := m.installRuleRoute(r); err != nil {
+			return err
+		}
+
+		err := ruleChange("add", nl.RuleAdd, r.netlinkRule(m.family), m.cfg.DryRun)
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("adding rule for %s: %w", r.Interface, err)
+		}
+	}
+	return nil
+}
+
+// installRuleRoute installs the default route via r's interface in its
+// table, replacing any existing one, e.g. if the gateway has changed.
+func (m *monitor) installRuleRoute(r *RuleConfig) error {
+	l := m.links[m.linkIndex(r.Interface)]
+	err := routeReplace(&netlink.Route{
+		Dst:       defaultDst(l.gw),
+		LinkIndex: l.iface.Index,
+		Gw:        l.gw.AsSlice(),
+		Table:     r.Table,
+		Protocol:  m.cfg.RouteProto,
+	}, m.cfg.DryRun)
+	if err != nil {
+		return fmt.Errorf("installing default route via %s in table %d: %w", l.iface.Name, r.Table, err)
+	}
+	return nil
+}
+
+// updateRuleRoutes reinstalls the routes for any rules via l, after its
+// gateway has changed.
+func (m *monitor) updateRuleRoutes(l *link) {
+	for i := range m.cfg.Rules {
+		r := &m.cfg.Rules[i]
+		if r.Interface != l.name {
+			continue
+		}
+		if err := m.installRuleRoute(r); err != nil {
+			m.log.Error("error updating rule route", "event", "error", "interface", l.iface.Name, "table", r.Table, "error", err)
+		}
+	}
+}
+
+// removeRules removes the rules and routes added by installRules. Failures
+// are logged but otherwise ignored.
+func (m *monitor) removeRules() {
+	for _, l := range m.links {
+		if l.checkTable == 0 {
+			continue
+		}
+		if err := ruleChange("del", nl.RuleDel, m.checkRule(l), m.cfg.DryRun); err != nil {
+			m.log.Error("error removing check rule", "event", "error", "interface", l.iface.Name, "gateway", l.gw, "table", l.checkTable, "error", err)
+		}
+		err := routeDel(&netlink.Route{
+			Dst:       defaultDst(l.gw),
+			LinkIndex: l.iface.Index,
+			Gw:        l.gw.AsSlice(),
+			Table:     l.checkTable,
+			Protocol:  m.cfg.RouteProto,
+		}, m.cfg.DryRun)
+		if err != nil {
+			m.log.Error("error removing check route", "event", "error", "interface", l.iface.Name, "gateway", l.gw, "table", l.checkTable, "error", err)
+		}
+	}
+
+	for i := range m.cfg.Rules {
+		r := &m.cfg.Rules[i]
+		if err := ruleChange("del", nl.RuleDel, r.netlinkRule(m.family), m.cfg.DryRun); err != nil {
+			m.log.Error("error removing rule", "event", "error", "interface", r.Interface, "table", r.Table, "error", err)
+		}
+
+		l := m.links[m.linkIndex(r.Interface)]
+		err := routeDel(&netlink.Route{
+			Dst:       defaultDst(l.gw),
+			LinkIndex: l.iface.Index,
+			Gw:        l.gw.AsSlice(),
+			Table:     r.Table,
+			Protocol:  m.cfg.RouteProto,
+		}, m.cfg.DryRun)
+		// Rules may share a table, in which case the route will
+		// already be gone.
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			m.log.Error("error removing rule route", "event", "error", "interface", r.Interface, "table", r.Table, "error", err)
+		}
+	}
+}
+
+// ruleChange performs the netlink rule operation fn, or with dryRun, only
+// logs the equivalent ip-rule(8) command.
+func ruleChange(op string, fn func(*netlink.Rule) error, rule *netlink.Rule, dryRun bool) error {
+	cmd := ipRuleCommand(op, rule)
+	if dryRun {
+		slog.Info("dry run; not changing rule", "event", "dry_run", "command", cmd)
+		return nil
+	}
+	slog.Debug("changing rule", "event", "rule_change", "command", cmd)
+	return fn(rule)
+}
+
+// ipRuleCommand formats rule as an ip-rule(8) command performing op, e.g.
+// "ip rule add from 10.5.0.0/24 lookup 100".
+func ipRuleCommand(op string, rule *netlink.Rule) string {
+	var b strings.Builder
+	b.WriteString("ip ")
+	if rule.Family == netlink.FAMILY_V6 {
+		b.WriteString("-6 ")
+	}
+	b.WriteString("rule " + op)
+	if rule.Priority >= 0 {
+		fmt.Fprintf(&b, " priority %d", rule.Priority)
+	}
+	if rule.Src != nil {
+		b.WriteString(" from " + rule.Src.String())
+	}
+	if rule.Mark >= 0 {
+		fmt.Fprintf(&b, " fwmark %#x", rule.Mark)
+	}
+	fmt.Fprintf(&b, " lookup %d", rule.Table)
+	return b.String()
+}
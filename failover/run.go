@@ -0,0 +1,625 @@
+// Package failover monitors the upstream connectivity of a primary network
+// interface and one or more backups, and switches the default route between
+// them as checks via each fail and recover. It's the engine of the
+// gateway-failover daemon, which is a thin command-line wrapper around Run,
+// and can be embedded in other programs the same way.
+package failover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ErrNotOnPrimary is returned by Run with Config.Oneshot if the primary
+// interface of a failover group isn't carrying the default route after the
+// check.
+var ErrNotOnPrimary = errors.New("not using the primary interface")
+
+// ErrCheck is returned by Run with Config.Oneshot if a failover group's check
+// failed with an error, which is logged.
+var ErrCheck = errors.New("error checking")
+
+// Run runs the failover groups configured by cfg, as returned by LoadConfig
+// or built on DefaultConfig, until ctx is done, then removes the policy
+// routing rules it installed and, with RestoreOnExit, restores the default
+// routes. With Oneshot, it instead does a single check of each group, prints
+// their status on stdout, and returns ErrNotOnPrimary or ErrCheck if that
+// didn't end with each of them on its primary interface. Each time a value is
+// received from cfg.Reload, the configuration is reloaded; see reloadConfig.
+// Each time one is received from cfg.CheckNow, every group is checked right
+// away, without waiting for its next check.
+//
+// Errors setting up the interfaces, routes, rules or listeners are retried
+// until cfg.StartupTimeout, and returned if they persist. Logging isn't set
+// up by Run, so that embedding programs can use their own logger as the slog
+// default; see SetupLogging.
+func Run(ctx context.Context, cfg *Config) error {
+	if cfg.groups == nil {
+		if err := cfg.resolveGroups(); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+	if len(cfg.fromEnv) > 0 {
+		slog.Info("flags set from the environment", "event", "startup", "variables", strings.Join(cfg.fromEnv, ","))
+	}
+	// Find out now, rather than when the first failover fails mid-outage.
+	if slices.ContainsFunc(cfg.groups, func(g *Config) bool { return !g.DryRun }) && !hasNetAdmin() {
+		return errors.New("changing routes requires CAP_NET_ADMIN, which this process doesn't have; run it as root, or in a container with the capability (e.g. docker run --cap-add=NET_ADMIN), or use --dry-run to only monitor and log the changes that would be made")
+	}
+
+	// Errors from here on may just be from starting before the rest of
+	// the system is ready, e.g. an interface or address not being there
+	// yet, so they're retried until the startup timeout rather than
+	// exiting right away, which under systemd's Restart= would quickly run
+	// through its start limit and leave the service dead.
+	start := time.Now()
+	deadline := start.Add(cfg.StartupTimeout)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var monitors []*monitor
+	fail := func(err error) error {
+		for _, m := range monitors {
+			m.removeRules()
+		}
+		if ctx.Err() != nil {
+			// Stopped while starting up.
+			return nil
+		}
+		return err
+	}
+	for _, g := range cfg.groups {
+		m, err := newMonitor(ctx, g, start)
+		if err != nil {
+			if g.id != "" {
+				err = fmt.Errorf("%s: %w", g.id, err)
+			}
+			return fail(err)
+		}
+		monitors = append(monitors, m)
+	}
+
+	if cfg.Oneshot {
+		return runOneshot(monitors)
+	}
+
+	if cfg.MetricsAddr != "" {
+		ln, err := retryListen(ctx, deadline, "error listening for metrics", cfg.MetricsAddr)
+		if err != nil {
+			return fail(fmt.Errorf("listening for metrics on %s: %w", cfg.MetricsAddr, err))
+		}
+		registerMetrics()
+		go serveMetrics(ctx, ln)
+		slog.Info("serving metrics", "event", "startup", "addr", ln.Addr())
+	}
+
+	if cfg.StatusAddr != "" {
+		ln, err := retryListen(ctx, deadline, "error listening for status", cfg.StatusAddr)
+		if err != nil {
+			return fail(fmt.Errorf("listening for status on %s: %w", cfg.StatusAddr, err))
+		}
+		go serveStatus(ctx, ln, monitors)
+		slog.Info("serving status", "event", "startup", "addr", ln.Addr())
+	}
+
+	if cfg.MQTTBroker != "" {
+		p := newMQTTPublisher(cfg.MQTTBroker, cfg.MQTTTopic, monitors)
+		defer p.close()
+		for _, m := range monitors {
+			m.mqtt = p
+		}
+		slog.Info("publishing to MQTT broker", "event", "startup", "broker", redactURL(cfg.MQTTBroker), "topic", cfg.MQTTTopic)
+	}
+
+	if cfg.PprofAddr != "" {
+		ln, err := retryListen(ctx, deadline, "error listening for pprof", pprofListenAddr(cfg.PprofAddr))
+		if err != nil {
+			return fail(fmt.Errorf("listening for pprof on %s: %w", cfg.PprofAddr, err))
+		}
+		go servePprof(ctx, ln)
+		slog.Info("serving pprof", "event", "startup", "addr", ln.Addr())
+	}
+
+	if cfg.ControlSocket != "" {
+		var ln net.Listener
+		err := retryStartup(ctx, slog.Default(), deadline, "error listening on control socket", func() (err error) {
+			ln, err = listenControl(cfg.ControlSocket)
+			return err
+		})
+		if err != nil {
+			return fail(fmt.Errorf("listening on control socket %s: %w", cfg.ControlSocket, err))
+		}
+		go serveControl(ctx, ln, monitors)
+		slog.Info("listening on control socket", "event", "startup", "path", cfg.ControlSocket)
+	}
+
+	// Do the first checks right away, so that we only report readiness to
+	// systemd once we know the state of the upstreams.
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		wg.Add(1)
+		go func(m *monitor) {
+			defer wg.Done()
+			m.check(ctx)
+		}(m)
+	}
+	wg.Wait()
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("error notifying systemd of readiness", "event", "error", "error", err)
+	}
+
+	for _, m := range monitors {
+		wg.Add(1)
+		go func(m *monitor) {
+			defer wg.Done()
+			m.run(ctx)
+		}(m)
+	}
+
+	var watchdogCh <-chan time.Time
+	watchdogInterval := sdWatchdogInterval()
+	if watchdogInterval > 0 {
+		watchdogTicker := time.NewTicker(watchdogInterval)
+		defer watchdogTicker.Stop()
+		watchdogCh = watchdogTicker.C
+	}
+
+	reload, checkNow := cfg.Reload, cfg.CheckNow
+mainLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("finished", "event", "shutdown")
+			sdNotify("STOPPING=1")
+			break mainLoop
+		case <-reload:
+			cfg = reloadConfig(ctx, cfg, monitors)
+		case <-checkNow:
+			slog.Info("checking now", "event", "check_now")
+			for _, m := range monitors {
+				// A check that's already been asked for
+				// will do.
+				select {
+				case m.checkNow <- struct{}{}:
+				default:
+				}
+			}
+		case <-watchdogCh:
+			// Only notify if no group is stuck in a check, which
+			// is what the watchdog is for.
+			ok := true
+			for _, m := range monitors {
+				if m.overdue(watchdogInterval) {
+					ok = false
+				}
+			}
+			if !ok {
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("error sending watchdog notification", "event", "error", "error", err)
+			}
+		}
+	}
+
+	wg.Wait()
+	for _, m := range monitors {
+		m.removeRules()
+		if m.cfg.RestoreOnExit && !m.passive() {
+			if err := m.restore(); err != nil {
+				m.log.Error("error restoring default route", "event", "error", "error", err)
+			}
+		}
+		m.hooks.Wait()
+	}
+	return nil
+}
+
+// maxStartupRetryDelay is the longest retryStartup waits between attempts.
+const maxStartupRetryDelay = 10 * time.Second
+
+// newMonitor sets up the monitor for the failover group configured by cfg,
+// including its interfaces and policy routing rules. If the interfaces or
+// routes can't be set up, it keeps trying until cfg.StartupTimeout after
+// start, or ctx is done.
+func newMonitor(ctx context.Context, cfg *Config, start time.Time) (*monitor, error) {
+	m := &monitor{
+		cfg:        cfg,
+		name:       cfg.id,
+		group:      cfg.Name,
+		family:     cfg.netlinkFamily(),
+		log:        monitorLogger(cfg),
+		control:    make(chan controlRequest),
+		reload:     make(chan reloadRequest),
+		checkNow:   make(chan struct{}, 1),
+		pinned:     -1,
+		interval:   cfg.Check.Interval,
+		counts:     make(map[string]int),
+		activeTime: make(map[string]time.Duration),
+	}
+
+	var err error
+	if cfg.Simulate {
+		if m.sim, err = newSimulator(cfg.SimulateFile); err != nil {
+			return nil, fmt.Errorf("loading simulate file %s: %w", cfg.SimulateFile, err)
+		}
+		m.log.Warn("SIMULATE MODE: no checks will be done; their results are simulated", "event", "startup", "simulate_file", cfg.SimulateFile, "dry_run", cfg.DryRun)
+	} else if m.checker, err = newChecker(&cfg.Check, m.family); err != nil {
+		return nil, fmt.Errorf("creating checker: %w", err)
+	}
+	m.routeDst = checkDestination(&cfg.Check, m.family)
+	m.dsts = cfg.routeDsts()
+
+	if cfg.ManageBackupLink {
+		m.raiseBackups()
+	}
+
+	deadline := start.Add(cfg.StartupTimeout)
+	if m.links, err = m.waitForLinks(ctx, deadline); err != nil {
+		return nil, fmt.Errorf("setting up interfaces: %w", err)
+	}
+	if m.sim == nil {
+		if err := newLinkCheckers(cfg, m.family, m.links); err != nil {
+			return nil, fmt.Errorf("creating checker: %w", err)
+		}
+	}
+	if cfg.PrimaryByMetric {
+		m.orderByMetric()
+	}
+	for _, l := range m.links {
+		msg := "backup gateway"
+		if l.name == m.links[0].name {
+			msg = "primary gateway"
+		}
+		args := []any{"event", "startup", "interface", l.iface.Name, "gateway", l.gw}
+		if l.name != l.iface.Name {
+			args = append(args, "mac", l.name)
+		}
+		m.log.Info(msg, args...)
+	}
+
+	if err := m.loadState(); err != nil {
+		m.log.Warn("error loading state", "event", "error", "path", cfg.StateFile, "error", err)
+	}
+
+	if m.initial, _, err = getDefaultRouteInterface(m.routeDst, m.dsts[0], cfg.Table); err != nil {
+		m.log.Warn("error getting initial default route", "event", "error", "error", err)
+	}
+
+	switch cfg.Mode {
+	case "metric":
+		if err := setupMetricRoutes(ctx, m, deadline); err != nil {
+			return nil, fmt.Errorf("installing default routes: %w", err)
+		}
+	case "ecmp":
+		// Start with every link in the route, until checks say
+		// otherwise.
+		for _, l := range m.links {
+			l.inRoute = true
+		}
+	}
+
+	if err := retryStartup(ctx, m.log, deadline, "error installing policy routing rules", m.installRules); err != nil {
+		return nil, fmt.Errorf("installing policy routing rules: %w", err)
+	}
+	m.logConfig("startup")
+	if cfg.StartupGrace > 0 && !cfg.Oneshot {
+		m.graceUntil = time.Now().Add(cfg.StartupGrace)
+		m.log.Info("startup grace period; checking without changing routes", "event", "startup", "until", m.graceUntil)
+	}
+	m.startupFailback = cfg.StartupFailback
+	return m, nil
+}
+
+// newLinkCheckers sets the checker of each of links whose interface has its
+// own check settings in cfg, for checks in the given netlink address family.
+func newLinkCheckers(cfg *Config, family int, links []*link) error {
+	for _, iface := range append([]InterfaceConfig{cfg.Primary}, cfg.Backups...) {
+		if iface.CheckIP == "" && iface.CheckMethod == "" {
+			continue
+		}
+		checker, err := newChecker(cfg.interfaceCheck(iface), family)
+		if err != nil {
+			return fmt.Errorf("checks via %s: %w", iface.Name, err)
+		}
+		for _, l := range links {
+			if l.name == iface.Name {
+				l.checker = checker
+			}
+		}
+	}
+	return nil
+}
+
+// newGroupLinks returns the links for the primary and backup interfaces of
+// the failover group configured by cfg, in priority order; see newLinks. If
+// gateway autodetection fails for an interface with links in prev, their
+// autodetected gateways are kept.
+func newGroupLinks(cfg *Config, family int, prev []*link) ([]*link, error) {
+	detected := func(name string) []netip.Addr {
+		var gws []netip.Addr
+		for _, l := range prev {
+			if l.name == name && l.detectGw {
+				gws = append(gws, l.gw)
+			}
+		}
+		return gws
+	}
+
+	links, err := newLinks(cfg.Primary, family, cfg.GatewayMethod, cfg.Check.Fwmark, detected(cfg.Primary.Name))
+	if err != nil {
+		return nil, fmt.Errorf("setting up primary interface: %w", err)
+	}
+	for _, b := range cfg.Backups {
+		backups, err := newLinks(b, family, cfg.GatewayMethod, cfg.Check.Fwmark, detected(b.Name))
+		if err != nil {
+			return nil, fmt.Errorf("setting up backup interface: %w", err)
+		}
+		links = append(links, backups...)
+	}
+
+	if err := validateLinks(links); err != nil {
+		return nil, fmt.Errorf("invalid interface configuration: %w", err)
+	}
+	assignCheckTables(links, cfg.Check.GatewayTable)
+	return links, nil
+}
+
+// waitForLinks sets up m's links with newGroupLinks, retrying with backoff
+// until deadline if that fails, since right after boot, interfaces may not
+// have come up or got a DHCP lease yet. It returns the last error if they
+// still can't be set up by then.
+func (m *monitor) waitForLinks(ctx context.Context, deadline time.Time) ([]*link, error) {
+	var links []*link
+	err := retryStartup(ctx, m.log, deadline, "error setting up interfaces", func() (err error) {
+		links, err = newGroupLinks(m.cfg, m.family, nil)
+		return err
+	})
+	return links, err
+}
+
+// retryStartup calls f until it succeeds, with backoff, logging msg on each
+// failure, and returns the last error if it's still failing at deadline, or
+// when ctx is done.
+func retryStartup(ctx context.Context, log *slog.Logger, deadline time.Time, msg string, f func() error) error {
+	delay := time.Second
+	for {
+		err := f()
+		if err == nil || !time.Now().Before(deadline) {
+			return err
+		}
+		delay = min(delay, time.Until(deadline))
+		log.Warn(msg+"; retrying", "event", "startup", "retry_in", delay.Round(time.Millisecond), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(2*delay, maxStartupRetryDelay)
+	}
+}
+
+// retryListen listens on TCP address addr with retryStartup, logging msg on
+// failure, since the address may not have been assigned yet, or a previous
+// instance may still be exiting.
+func retryListen(ctx context.Context, deadline time.Time, msg, addr string) (net.Listener, error) {
+	var ln net.Listener
+	err := retryStartup(ctx, slog.Default(), deadline, msg, func() (err error) {
+		ln, err = net.Listen("tcp", addr)
+		return err
+	})
+	return ln, err
+}
+
+// runOneshot does a single check with each of monitors, switching the default
+// route if needed, and prints their status. It returns ErrCheck if a check
+// failed with an error, or otherwise, ErrNotOnPrimary if the primary interface
+// of a group isn't carrying the default route afterwards.
+func runOneshot(monitors []*monitor) error {
+	errs := make([]error, len(monitors))
+	var wg sync.WaitGroup
+	for i, m := range monitors {
+		// There's no history to apply the thresholds to, nor will
+		// there be a later check for the primary to have stayed up
+		// until, so it's failed back to as soon as it passes.
+		m.cfg.FailThreshold = 1
+		m.cfg.RecoverThreshold = 1
+		m.cfg.PrimaryStableFor = 0
+
+		wg.Add(1)
+		go func(i int, m *monitor) {
+			defer wg.Done()
+			errs[i] = m.doCheckOnce(context.Background())
+			m.hooks.Wait()
+			m.persist()
+		}(i, m)
+	}
+	wg.Wait()
+
+	st, onPrimary := statusOf(monitors)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+
+	var err error
+	if !onPrimary {
+		err = ErrNotOnPrimary
+	}
+	for i, m := range monitors {
+		if errs[i] != nil {
+			m.log.Error("error checking", "event", "error", "error", errs[i])
+			err = ErrCheck
+		}
+	}
+	return err
+}
+
+// setupMetricRoutes installs the default routes for --mode=metric, preferring
+// whichever of m's interfaces already carries the default route, if any, and
+// otherwise the primary, retrying until deadline if that fails. It warns
+// about any existing routes that would take precedence.
+func setupMetricRoutes(ctx context.Context, m *monitor, deadline time.Time) error {
+	for _, dst := range m.dsts {
+		routes, err := shadowingDefaultRoutes(dst, m.cfg.RouteMetric, m.cfg.Table)
+		if err != nil {
+			m.log.Warn("error listing default routes", "event", "error", "error", err)
+		}
+		for _, route := range routes {
+			m.log.Warn("existing default route has a lower metric than ours and will take precedence", "event", "startup", "route", route.String(), "metric", route.Priority, "route_metric", m.cfg.RouteMetric)
+		}
+	}
+
+	active := m.linkIndex(m.initial)
+	if active < 0 {
+		active = 0
+	}
+	return retryStartup(ctx, m.log, deadline, "error installing default routes", func() error {
+		return m.setRouteMetrics(active)
+	})
+}
+
+// newLinks looks up the interface for cfg, and returns a link for each of its
+// gateways, autodetecting the gateway with the given method if none are
+// given explicitly, or falling back to the previously detected ones, if any,
+// if that fails. Checks via the links use cfg's firewall mark, or fwmark if
+// it has none.
+func newLinks(cfg InterfaceConfig, family int, method string, fwmark uint32, detected []netip.Addr) ([]*link, error) {
+	iface, err := lookupInterface(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	gws, err := parseOrGetGateways(cfg.Gateway, iface, family, method)
+	if err != nil && cfg.Gateway == "" && len(detected) > 0 {
+		gws, err = detected, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("detecting gateway for %s: %w", cfg.Name, err)
+	}
+	if cfg.Fwmark != 0 {
+		fwmark = cfg.Fwmark
+	}
+	weight := cfg.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	links := make([]*link, len(gws))
+	for i, gw := range gws {
+		links[i] = &link{name: cfg.Name, iface: iface, gw: gw, detectGw: cfg.Gateway == "", fwmark: fwmark, weight: weight}
+	}
+	return links, nil
+}
+
+// lookupInterface returns the interface with the given name, or if name is a
+// MAC address, the one with that hardware address, for interfaces whose
+// names aren't stable. VLANs, bond and bridge ports, and other interfaces
+// stacked on another one share its MAC address, so they're only matched if
+// nothing else is.
+func lookupInterface(name string) (*net.Interface, error) {
+	mac, err := net.ParseMAC(name)
+	if err != nil {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			if base, parent, ok := strings.Cut(name, "@"); ok {
+				// As "ip link" shows VLANs and other stacked
+				// interfaces, e.g. "eth0.100@eth0".
+				return nil, fmt.Errorf("getting interface %q: %w; the interface is named %q, without its parent %q", name, err, base, parent)
+			}
+			return nil, fmt.Errorf("getting interface %q: %w", name, err)
+		}
+		return iface, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing interfaces: %w", err)
+	}
+	var matches, stacked []*net.Interface
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !bytes.Equal(iface.HardwareAddr, mac) {
+			continue
+		}
+		if l, err := nl.LinkByIndex(iface.Index); err == nil && (l.Attrs().ParentIndex != 0 || l.Attrs().MasterIndex != 0) {
+			stacked = append(stacked, iface)
+		} else {
+			matches = append(matches, iface)
+		}
+	}
+	if len(matches) == 0 {
+		matches = stacked
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no interface with MAC address %v", mac)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, iface := range matches {
+		names[i] = iface.Name
+	}
+	return nil, fmt.Errorf("MAC address %v is shared by interfaces %s; give the interface by name instead", mac, strings.Join(names, ", "))
+}
+
+// validateLinks checks that links are all different interfaces with
+// different gateways, except for the gateways of a single interface, and
+// that each gateway is reachable directly on its interface, since otherwise
+// switching between them won't do anything useful.
+func validateLinks(links []*link) error {
+	for i, l := range links {
+		for _, o := range links[:i] {
+			// The links for an interface's gateways share its
+			// net.Interface.
+			if l.iface.Index == o.iface.Index && l.iface != o.iface {
+				return fmt.Errorf("interfaces %s and %s are the same interface (index %d)", o.iface.Name, l.iface.Name, l.iface.Index)
+			}
+			// Link-local gateways are only unique per interface.
+			if l.gw == o.gw && !l.gw.IsLinkLocalUnicast() {
+				return fmt.Errorf("interfaces %s and %s have the same gateway %v", o.iface.Name, l.iface.Name, l.gw)
+			}
+		}
+		if err := checkGatewayOnLink(l.iface, l.gw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// familyNetwork returns the network name for base ("tcp", "udp", or "ip")
+// restricted to the given netlink address family, e.g. "tcp6".
+func familyNetwork(base string, family int) string {
+	if family == netlink.FAMILY_V6 {
+		return base + "6"
+	}
+	return base + "4"
+}
+
+// ipVersion returns the IP version number (4 or 6) for the given netlink
+// address family, for use in messages.
+func ipVersion(family int) int {
+	if family == netlink.FAMILY_V6 {
+		return 6
+	}
+	return 4
+}
+
+// familyMatches reports whether addr is in the given netlink address family.
+func familyMatches(addr netip.Addr, family int) bool {
+	if family == netlink.FAMILY_V6 {
+		return addr.Is6() && !addr.Is4In6()
+	}
+	return addr.Unmap().Is4()
+}
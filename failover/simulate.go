@@ -0,0 +1,172 @@
+package failover
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errSimulatedFailure is the check error for a link whose simulated result
+// is down, with --simulate.
+var errSimulatedFailure = errors.New("simulated failure")
+
+// A simulator supplies the check results with --simulate, instead of doing
+// the checks. Each interface's results come from the sequence given for it in
+// the simulate file, one per check, with the last repeating once it runs out,
+// unless a result has been set for it with the "simulate" control command.
+// Interfaces with neither are always up. It's safe for concurrent use.
+type simulator struct {
+	mu sync.Mutex
+	// seqs are the sequences of results for each interface from the
+	// simulate file, true meaning up, and pos how many of them each link
+	// has used.
+	seqs map[string][]bool
+	pos  map[*link]int
+	// set are the results set with the control command.
+	set map[string]bool
+}
+
+// newSimulator returns a simulator with the sequences in the file at path,
+// if it's non-empty.
+func newSimulator(path string) (*simulator, error) {
+	s := &simulator{set: make(map[string]bool)}
+	if err := s.load(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replaces s's sequences with the ones in the file at path, or none if
+// it's empty, starting them from the beginning. Each line of the file is an
+// interface name followed by a sequence of "up" or "down" results, each of
+// which may be repeated N times with "*N", e.g. "eth0 up down*3 up". Blank
+// lines and lines starting with "#" are ignored.
+func (s *simulator) load(path string) error {
+	seqs := make(map[string][]bool)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for n := 1; sc.Scan(); n++ {
+			fields := strings.Fields(sc.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			seq, err := parseSimulatedResults(fields[1:])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			} else if seqs[fields[0]] != nil {
+				return fmt.Errorf("%s:%d: interface %s given more than once", path, n, fields[0])
+			}
+			seqs[fields[0]] = seq
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seqs = seqs
+	s.pos = make(map[*link]int)
+	return nil
+}
+
+// parseSimulatedResults parses a sequence of simulated results; see load.
+func parseSimulatedResults(fields []string) ([]bool, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("no results given")
+	}
+	var seq []bool
+	for _, f := range fields {
+		result, count, ok := strings.Cut(f, "*")
+		n := 1
+		if ok {
+			var err error
+			if n, err = strconv.Atoi(count); err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid repeat count in %q", f)
+			}
+		}
+		up, err := parseSimulatedResult(result)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			seq = append(seq, up)
+		}
+	}
+	return seq, nil
+}
+
+func parseSimulatedResult(s string) (bool, error) {
+	switch s {
+	case "up":
+		return true, nil
+	case "down":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid simulated result %q; expected up or down", s)
+}
+
+// check returns the simulated result of the next check via l.
+func (s *simulator) check(l *link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	up, ok := s.set[l.iface.Name]
+	if !ok {
+		up = true
+		if seq := s.seqs[l.iface.Name]; len(seq) > 0 {
+			i := min(s.pos[l], len(seq)-1)
+			up = seq[i]
+			s.pos[l] = i + 1
+		}
+	}
+	if !up {
+		return errSimulatedFailure
+	}
+	return nil
+}
+
+// setResult sets the result of every check via the named interface from now
+// on to up or down, or with result "file", returns it to the rest of its
+// sequence from the simulate file.
+func (s *simulator) setResult(name, result string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result == "file" {
+		delete(s.set, name)
+		return nil
+	}
+	up, err := parseSimulatedResult(result)
+	if err != nil {
+		return err
+	}
+	s.set[name] = up
+	return nil
+}
+
+// currentRoute returns the interface carrying the default route and its
+// gateway, as getDefaultRouteInterface does. With --simulate and --dry-run,
+// once the monitor has switched the default route, it's where the route
+// would have been switched to instead, so that the whole state machine can be
+// rehearsed without touching the routing table.
+func (m *monitor) currentRoute() (string, netip.Addr, error) {
+	if m.sim != nil && m.cfg.DryRun {
+		m.mu.Lock()
+		active, gw := m.active, m.activeGw
+		m.mu.Unlock()
+		if active != "" {
+			return active, gw, nil
+		}
+	}
+	return getDefaultRouteInterface(m.routeDst, m.dsts[0], m.cfg.Table)
+}
@@ -0,0 +1,108 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxSourcePortTries is the most ports of a --check-source-port range that
+// are tried for a check before giving up, if they're all in use.
+const maxSourcePortTries = 32
+
+// A portRange is the range of source ports, from lo to hi inclusive, that the
+// sockets of the tcp, http and dns check methods are bound to with
+// --check-source-port, so that checks match firewall rules allowing only
+// those ports. The zero portRange leaves the port to the kernel.
+type portRange struct {
+	lo, hi uint16
+}
+
+// parsePortRange parses s, a port, e.g. "40000", or range of them, e.g.
+// "40000-40099". An empty s is the zero portRange.
+func parsePortRange(s string) (portRange, error) {
+	if s == "" {
+		return portRange{}, nil
+	}
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err := strconv.ParseUint(strings.TrimSpace(loStr), 10, 16)
+	if err != nil || lo == 0 {
+		return portRange{}, fmt.Errorf("invalid source port %q", loStr)
+	}
+	hi, err := strconv.ParseUint(strings.TrimSpace(hiStr), 10, 16)
+	if err != nil || hi == 0 {
+		return portRange{}, fmt.Errorf("invalid source port %q", hiStr)
+	}
+	if hi < lo {
+		return portRange{}, fmt.Errorf("source port range %q ends before it starts", s)
+	}
+	return portRange{lo: uint16(lo), hi: uint16(hi)}, nil
+}
+
+// dialFrom dials addr with d from src and, unless ports is the zero
+// portRange, a port in it. Ports are tried in turn from a random one, to
+// spread checks over the range, while they're in use, e.g. by a concurrent
+// check. TCP sockets are bound with SO_REUSEADDR and reset rather than left
+// in TIME_WAIT on closing, so that a port can be reused by the next check.
+func dialFrom(ctx context.Context, d net.Dialer, network, addr string, src netip.Addr, ports portRange) (net.Conn, error) {
+	tcp := strings.HasPrefix(network, "tcp")
+	localAddr := func(port int) net.Addr {
+		if tcp {
+			return &net.TCPAddr{IP: src.AsSlice(), Port: port}
+		}
+		return &net.UDPAddr{IP: src.AsSlice(), Port: port}
+	}
+	if ports == (portRange{}) {
+		d.LocalAddr = localAddr(0)
+		return d.DialContext(ctx, network, addr)
+	}
+
+	if tcp {
+		control := d.Control
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					serr = os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+				}
+			}); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	n := int(ports.hi-ports.lo) + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < min(n, maxSourcePortTries); i++ {
+		d.LocalAddr = localAddr(int(ports.lo) + (start+i)%n)
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, addr)
+		if err == nil {
+			if c, ok := conn.(*net.TCPConn); ok {
+				c.SetLinger(0)
+			}
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free source port in %d-%d: %w", ports.lo, ports.hi, err)
+}
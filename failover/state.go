@@ -0,0 +1,134 @@
+package failover
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedState is the monitor state persisted to --state-file, so that a
+// restart doesn't lose the check history that the thresholds and
+// --primary-stable-for depend on.
+type savedState struct {
+	SavedAt        time.Time   `json:"saved_at"`
+	Active         string      `json:"active"`
+	LastTransition time.Time   `json:"last_transition"`
+	Links          []savedLink `json:"links"`
+}
+
+type savedLink struct {
+	Interface    string    `json:"interface"`
+	Gateway      string    `json:"gateway"`
+	Failures     int       `json:"failures"`
+	Successes    int       `json:"successes"`
+	HealthySince time.Time `json:"healthy_since"`
+}
+
+// saveState writes m's state to the configured state file, if any. The file
+// is replaced atomically, so that it's never left partially written.
+func (m *monitor) saveState() error {
+	path := m.cfg.StateFile
+	if path == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	st := savedState{
+		SavedAt:        time.Now(),
+		Active:         m.active,
+		LastTransition: m.lastTransition,
+	}
+	for _, l := range m.links {
+		st.Links = append(st.Links, savedLink{
+			Interface:    l.iface.Name,
+			Gateway:      l.gw.String(),
+			Failures:     l.failures,
+			Successes:    l.successes,
+			HealthySince: l.healthySince,
+		})
+	}
+	m.mu.Unlock()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("creating state file: %w", err)
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing state file: %w", err)
+	}
+	return nil
+}
+
+// loadState restores the check history of m's links from the configured
+// state file, if any. State saved too long ago to reflect the links' current
+// health is ignored, as is state for links that are no longer configured.
+func (m *monitor) loadState() error {
+	path := m.cfg.StateFile
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st savedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+
+	// By the time we'd have checked again anyway, the saved results are
+	// as good as new ones.
+	if age := time.Since(st.SavedAt); age > 2*m.cfg.Check.MaxInterval {
+		m.log.Info("ignoring stale state file", "event", "state", "path", path, "age", age.Round(time.Second))
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastTransition = st.LastTransition
+	for _, sl := range st.Links {
+		gw, err := netip.ParseAddr(sl.Gateway)
+		if err != nil {
+			continue
+		}
+		for _, l := range m.links {
+			if l.iface.Name == sl.Interface && l.gw == gw {
+				l.failures = sl.Failures
+				l.successes = sl.Successes
+				l.healthySince = sl.HealthySince
+			}
+		}
+	}
+	m.log.Info("restored state", "event", "state", "path", path, "active", st.Active, "saved_at", st.SavedAt)
+	return nil
+}
+
+// persist saves m's state, logging any error.
+func (m *monitor) persist() {
+	if err := m.saveState(); err != nil {
+		m.log.Error("error saving state", "event", "error", "path", m.cfg.StateFile, "error", err)
+	}
+}
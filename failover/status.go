@@ -0,0 +1,186 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// status is a snapshot of a monitor's state, as served on /status. The
+// top-level check results are for the primary interface, via its first
+// gateway; any others are listed with the backups.
+type status struct {
+	Primary              interfaceStatus   `json:"primary"`
+	Backups              []interfaceStatus `json:"backups"`
+	Active               string            `json:"active"`
+	ActiveGateway        string            `json:"active_gateway,omitempty"`
+	Pinned               string            `json:"pinned,omitempty"`
+	Passive              bool              `json:"passive,omitempty"`
+	Nexthops             []string          `json:"nexthops,omitempty"`
+	Simulated            bool              `json:"simulated,omitempty"`
+	LastCheck            *time.Time        `json:"last_check,omitempty"`
+	LastCheckOK          bool              `json:"last_check_ok"`
+	LastCheckError       string            `json:"last_check_error,omitempty"`
+	ConsecutiveFailures  int               `json:"consecutive_failures"`
+	ConsecutiveSuccesses int               `json:"consecutive_successes"`
+}
+
+type interfaceStatus struct {
+	Name                 string     `json:"name"`
+	Gateway              string     `json:"gateway"`
+	LastCheck            *time.Time `json:"last_check,omitempty"`
+	LastCheckOK          bool       `json:"last_check_ok"`
+	LastCheckError       string     `json:"last_check_error,omitempty"`
+	ConsecutiveFailures  int        `json:"consecutive_failures"`
+	ConsecutiveSuccesses int        `json:"consecutive_successes"`
+	ThroughputMbps       *float64   `json:"throughput_mbps,omitempty"`
+	InboundReachable     *bool      `json:"inbound_reachable,omitempty"`
+	PublicIP             string     `json:"public_ip,omitempty"`
+	Score                *float64   `json:"score,omitempty"`
+}
+
+// status returns a snapshot of the monitor's current state.
+func (m *monitor) status() status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	primary := m.links[0].status()
+	st := status{
+		Primary:              primary,
+		Active:               m.active,
+		LastCheck:            primary.LastCheck,
+		LastCheckOK:          primary.LastCheckOK,
+		LastCheckError:       primary.LastCheckError,
+		ConsecutiveFailures:  primary.ConsecutiveFailures,
+		ConsecutiveSuccesses: primary.ConsecutiveSuccesses,
+		Simulated:            m.sim != nil,
+		Passive:              m.notMaster,
+	}
+	if m.activeGw.IsValid() {
+		st.ActiveGateway = m.activeGw.String()
+	}
+	st.Nexthops = m.nexthops
+	if m.pinned >= 0 {
+		st.Pinned = m.links[m.pinned].iface.Name
+	}
+	for _, l := range m.links[1:] {
+		st.Backups = append(st.Backups, l.status())
+	}
+	return st
+}
+
+// status returns a snapshot of l's state. The monitor's mu must be held.
+func (l *link) status() interfaceStatus {
+	st := interfaceStatus{
+		Name:                 l.iface.Name,
+		Gateway:              l.gw.String(),
+		ConsecutiveFailures:  l.failures,
+		ConsecutiveSuccesses: l.successes,
+	}
+	if !l.lastCheck.IsZero() {
+		t := l.lastCheck
+		st.LastCheck = &t
+		st.LastCheckOK = l.lastCheckErr == nil
+		if l.lastCheckErr != nil {
+			st.LastCheckError = l.lastCheckErr.Error()
+		}
+	}
+	if l.hasThroughput {
+		mbps := l.throughput
+		st.ThroughputMbps = &mbps
+	}
+	if l.hasInbound {
+		inbound := l.inbound
+		st.InboundReachable = &inbound
+		st.PublicIP = l.publicIP
+	}
+	if len(l.results) > 0 {
+		score := l.score()
+		st.Score = &score
+	}
+	return st
+}
+
+// statusOf returns the status of monitors for reporting: that of the only
+// monitor if there are no failover groups, or otherwise a map of each
+// group's name to its status. It also reports whether the primary interface
+// of every group is active.
+func statusOf(monitors []*monitor) (v any, onPrimary bool) {
+	onPrimary = true
+	groups := make(map[string]status, len(monitors))
+	for _, m := range monitors {
+		st := m.status()
+		if st.Active != st.Primary.Name {
+			onPrimary = false
+		}
+		if m.name == "" {
+			return st, onPrimary
+		}
+		groups[m.name] = st
+	}
+	return groups, onPrimary
+}
+
+// livenessGrace is how long a monitor's next check may be overdue before
+// /healthz reports that its run loop is stuck.
+const livenessGrace = time.Minute
+
+// serveStatus serves the status of monitors as JSON on /status from ln until
+// ctx is done; see statusOf. The response status is 200 when the primary
+// interface of every group is active and 503 otherwise. Their recent
+// transitions are served on /history; see historyOf.
+//
+// For Kubernetes liveness and readiness probes, which shouldn't depend on
+// the upstreams, /healthz responds 200 unless a monitor's run loop is stuck,
+// its next check being more than livenessGrace overdue, and /readyz responds
+// 200 once every monitor has detected its gateways and completed its first
+// check, with 503 otherwise.
+func serveStatus(ctx context.Context, ln net.Listener, monitors []*monitor) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		st, onPrimary := statusOf(monitors)
+
+		w.Header().Set("Content-Type", "application/json")
+		if onPrimary {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(historyOf(monitors))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range monitors {
+			if m.overdue(livenessGrace) {
+				http.Error(w, checkGroup(m, "check loop stuck"), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range monitors {
+			if !m.ready() {
+				http.Error(w, checkGroup(m, "first check not completed"), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	serveHTTP(ctx, ln, mux)
+}
+
+// checkGroup returns msg, prefixed with m's failover group, if it has one,
+// for a /healthz or /readyz response.
+func checkGroup(m *monitor, msg string) string {
+	if m.name != "" {
+		return "group " + m.name + ": " + msg
+	}
+	return msg
+}
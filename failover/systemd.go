@@ -0,0 +1,43 @@
+package failover
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state (e.g. "READY=1") to systemd's notification socket, as
+// sd_notify(3) does. It's a no-op if we weren't started by systemd with
+// NotifyAccess set.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// A leading "@" denotes a socket in the abstract namespace, which the
+	// net package handles for us.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often systemd expects a WATCHDOG=1
+// notification, which is half of the unit's WatchdogSec, or zero if the
+// watchdog isn't enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,47 @@
+package failover
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// vrrpMaster reports whether the VRRP state file at path says this node is the
+// master. A missing file means it isn't.
+func vrrpMaster(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(strings.TrimSpace(string(b)), "MASTER"), nil
+}
+
+// passive reports whether m mustn't change routes because, with
+// PassiveUnlessMaster, this node isn't the VRRP master, so that of a pair of
+// routers running us, only the master does. The state file is read each
+// time, and changes in it are logged. If it can't be read, we're passive.
+func (m *monitor) passive() bool {
+	path := m.cfg.PassiveUnlessMaster
+	if path == "" {
+		return false
+	}
+	master, err := vrrpMaster(path)
+	if err != nil {
+		m.log.Warn("error reading VRRP state file; not changing routes", "event", "error", "path", path, "error", err)
+	}
+
+	m.mu.Lock()
+	changed := m.notMaster == master
+	m.notMaster = !master
+	m.mu.Unlock()
+	switch {
+	case changed && master:
+		m.log.Info("VRRP master; managing routes", "event", "vrrp", "path", path)
+	case changed:
+		m.log.Info("not VRRP master; only checking, without changing routes", "event", "vrrp", "path", path)
+	}
+	return !master
+}
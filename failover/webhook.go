@@ -0,0 +1,78 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 5 * time.Second
+)
+
+// webhookEvent is the JSON payload POSTed to --webhook-url when the default
+// route is switched.
+type webhookEvent struct {
+	Event     string    `json:"event"` // "failover", "failback" or "all_down"
+	Group     string    `json:"group,omitempty"`
+	Family    int       `json:"family"`
+	Timestamp time.Time `json:"timestamp"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+}
+
+// sendWebhook POSTs ev to url, retrying a couple of times on failure.
+// Failures are logged to log but otherwise ignored.
+func sendWebhook(log *slog.Logger, url string, headers []string, ev webhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("error encoding webhook event", "event", "webhook", "error", err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = postWebhook(url, headers, body)
+		if err == nil {
+			return
+		}
+		log.Warn("error sending webhook", "event", "webhook", "webhook_event", ev.Event, "attempt", attempt, "attempts", webhookAttempts, "error", err)
+		if attempt < webhookAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func postWebhook(url string, headers []string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range headers {
+		key, value, _ := strings.Cut(h, ":")
+		req.Header.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
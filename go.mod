@@ -1,10 +1,27 @@
 module github.com/andrew-d/gateway-failover
 
-go 1.20
+go 1.21
 
-require github.com/vishvananda/netlink v1.1.0
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/prometheus/client_golang v1.17.0
+	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )